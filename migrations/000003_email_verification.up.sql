@@ -0,0 +1 @@
+ALTER TABLE accounts ADD COLUMN email_verified_at TIMESTAMPTZ;
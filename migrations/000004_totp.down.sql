@@ -0,0 +1,4 @@
+ALTER TABLE accounts
+  DROP COLUMN totp_secret,
+  DROP COLUMN totp_enabled_at,
+  DROP COLUMN totp_recovery_codes;
@@ -0,0 +1,4 @@
+ALTER TABLE accounts
+  ADD COLUMN totp_secret TEXT,
+  ADD COLUMN totp_enabled_at TIMESTAMPTZ,
+  ADD COLUMN totp_recovery_codes TEXT[] NOT NULL DEFAULT '{}';
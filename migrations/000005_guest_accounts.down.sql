@@ -0,0 +1,8 @@
+DELETE FROM accounts WHERE is_guest;
+
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_guest_or_credentials,
+  DROP COLUMN device_id_hash,
+  DROP COLUMN is_guest,
+  ALTER COLUMN email SET NOT NULL,
+  ALTER COLUMN password_hash SET NOT NULL;
@@ -0,0 +1,8 @@
+ALTER TABLE accounts
+  ALTER COLUMN email DROP NOT NULL,
+  ALTER COLUMN password_hash DROP NOT NULL,
+  ADD COLUMN is_guest BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN device_id_hash VARCHAR(64) UNIQUE,
+  ADD CONSTRAINT accounts_guest_or_credentials CHECK (
+    is_guest OR (email IS NOT NULL AND password_hash IS NOT NULL)
+  );
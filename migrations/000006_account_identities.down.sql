@@ -0,0 +1,11 @@
+DROP TABLE account_identities;
+
+DELETE FROM accounts WHERE NOT is_guest AND password_hash IS NULL;
+
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_guest_or_email,
+  ADD CONSTRAINT accounts_guest_or_credentials CHECK (
+    is_guest OR (email IS NOT NULL AND password_hash IS NOT NULL)
+  );
+
+ALTER TABLE accounts DROP CONSTRAINT accounts_pkey;
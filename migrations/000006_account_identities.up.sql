@@ -0,0 +1,16 @@
+ALTER TABLE accounts ADD PRIMARY KEY (id);
+
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_guest_or_credentials,
+  ADD CONSTRAINT accounts_guest_or_email CHECK (is_guest OR email IS NOT NULL);
+
+CREATE TABLE account_identities (
+  id SERIAL PRIMARY KEY,
+  account_id INT NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+  provider VARCHAR(64) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  email VARCHAR(255),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (provider, subject),
+  UNIQUE (account_id, provider)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE sanctions (
+  id SERIAL PRIMARY KEY,
+  account_id INT NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+  kind VARCHAR(16) NOT NULL CHECK (kind IN ('ban', 'suspension', 'ranked_ban', 'mute')),
+  reason TEXT NOT NULL,
+  issued_by INT REFERENCES accounts (id) ON DELETE SET NULL,
+  starts_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ends_at TIMESTAMPTZ,
+  appeal_note TEXT NOT NULL DEFAULT '',
+  lifted_at TIMESTAMPTZ,
+  lifted_by INT REFERENCES accounts (id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT sanctions_suspension_ends CHECK (kind <> 'suspension' OR ends_at IS NOT NULL),
+  CONSTRAINT sanctions_ends_after_start CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX sanctions_account_id_idx ON sanctions (account_id);
@@ -0,0 +1,17 @@
+CREATE TABLE player_profiles (
+  account_id INT PRIMARY KEY REFERENCES accounts (id) ON DELETE CASCADE,
+  handle VARCHAR(32),
+  display_name VARCHAR(32) NOT NULL DEFAULT '',
+  avatar_url VARCHAR(512) NOT NULL DEFAULT '',
+  level INT NOT NULL DEFAULT 1,
+  rank VARCHAR(32) NOT NULL DEFAULT 'unranked',
+  visibility VARCHAR(16) NOT NULL DEFAULT 'public' CHECK (visibility IN ('public', 'private')),
+  show_rank BOOLEAN NOT NULL DEFAULT TRUE,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX player_profiles_handle_idx ON player_profiles (LOWER(handle));
+
+-- only the first name, last names were never shown to other players
+INSERT INTO player_profiles (account_id, display_name)
+SELECT id, LEFT(COALESCE(first_name, ''), 32) FROM accounts;
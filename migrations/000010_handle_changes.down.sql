@@ -0,0 +1 @@
+ALTER TABLE player_profiles DROP COLUMN handle_changed_at;
@@ -0,0 +1 @@
+ALTER TABLE player_profiles ADD COLUMN handle_changed_at TIMESTAMPTZ;
@@ -0,0 +1,7 @@
+DELETE FROM accounts WHERE deleted_at IS NOT NULL AND email IS NULL AND NOT is_guest;
+
+ALTER TABLE accounts
+  DROP CONSTRAINT accounts_guest_or_email,
+  ADD CONSTRAINT accounts_guest_or_email CHECK (is_guest OR email IS NOT NULL),
+  DROP COLUMN deleted_at,
+  DROP COLUMN deletion_scheduled_for;
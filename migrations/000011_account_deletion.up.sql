@@ -0,0 +1,7 @@
+ALTER TABLE accounts
+  ADD COLUMN deletion_scheduled_for TIMESTAMPTZ,
+  ADD COLUMN deleted_at TIMESTAMPTZ,
+  DROP CONSTRAINT accounts_guest_or_email,
+  ADD CONSTRAINT accounts_guest_or_email CHECK (is_guest OR email IS NOT NULL OR deleted_at IS NOT NULL);
+
+CREATE INDEX accounts_deletion_scheduled_for_idx ON accounts (deletion_scheduled_for) WHERE deletion_scheduled_for IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE player_settings;
+DROP TABLE player_storage;
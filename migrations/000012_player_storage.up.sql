@@ -0,0 +1,15 @@
+CREATE TABLE player_storage (
+  account_id INT NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+  key VARCHAR(64) NOT NULL,
+  value JSONB NOT NULL,
+  version INT NOT NULL DEFAULT 1,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (account_id, key)
+);
+
+CREATE TABLE player_settings (
+  account_id INT PRIMARY KEY REFERENCES accounts (id) ON DELETE CASCADE,
+  settings JSONB NOT NULL,
+  version INT NOT NULL DEFAULT 1,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
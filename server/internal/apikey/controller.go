@@ -0,0 +1,121 @@
+package apikey
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server/internal/middlewares"
+	"server/internal/models"
+	"server/pkg/betools"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Controller struct {
+	svc *Service
+}
+
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
+}
+
+func (c *Controller) GetRoutes() []betools.Route {
+	routes := betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+			middlewares.RequireRole(models.RoleAdmin),
+		},
+		[]betools.Route{
+			{
+				Method:      "POST",
+				Pattern:     "/admin/api-keys",
+				HandlerFunc: c.handleCreate,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.CreateAPIKeyRequest](),
+				},
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/admin/api-keys",
+				HandlerFunc: c.handleList,
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/admin/api-keys/{id}",
+				HandlerFunc: c.handleRevoke,
+			},
+		},
+	)
+
+	return append(routes, betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.APIKeyMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "GET",
+				Pattern:     "/service/me",
+				HandlerFunc: c.handleGetServiceMe,
+			},
+		},
+	)...)
+}
+
+func (c *Controller) handleCreate(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.CreateAPIKeyRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.Create(uid, req)
+	if err != nil {
+		slog.Error("create api key", "uid", uid, "name", req.Name, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to create api key")
+		return
+	}
+
+	slog.Info("api key created", "uid", uid, "key_id", res.ID, "name", res.Name, "scopes", res.Scopes)
+
+	betools.SendCreatedResponse(w, res)
+}
+
+func (c *Controller) handleList(w http.ResponseWriter, r *http.Request) {
+	res, err := c.svc.List()
+	if err != nil {
+		slog.Error("list api keys", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list api keys")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		slog.Error("revoke api key", "id", chi.URLParam(r, "id"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke api key")
+		return
+	}
+
+	if err := c.svc.Revoke(id); errors.Is(err, ErrNotFound) {
+		slog.Error("revoke api key", "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "api key not found")
+		return
+	} else if err != nil {
+		slog.Error("revoke api key", "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke api key")
+		return
+	}
+
+	slog.Info("api key revoked", "uid", uid, "key_id", id)
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleGetServiceMe(w http.ResponseWriter, r *http.Request) {
+	betools.SendOKResponse(w, betools.GetServiceCtx(r))
+}
@@ -1,11 +1,20 @@
 package auth
 
 import (
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"server/internal/env"
+	"server/internal/jwtkeys"
+	"server/internal/middlewares"
 	"server/internal/models"
 	"server/pkg/betools"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type Controller struct {
@@ -19,7 +28,7 @@ func NewController(svc *Service) *Controller {
 }
 
 func (c *Controller) GetRoutes() []betools.Route {
-	return []betools.Route{
+	routes := []betools.Route{
 		{
 			Method:      "POST",
 			Pattern:     "/auth/register",
@@ -36,12 +45,170 @@ func (c *Controller) GetRoutes() []betools.Route {
 				betools.BodyParser[models.LoginRequest](),
 			},
 		},
+		{
+			Method:      "GET",
+			Pattern:     "/.well-known/jwks.json",
+			HandlerFunc: c.handleJWKS,
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/guest",
+			HandlerFunc: c.handleGuestLogin,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.GuestLoginRequest](),
+			},
+		},
+		{
+			Method:      "GET",
+			Pattern:     "/auth/oauth/{provider}/start",
+			HandlerFunc: c.handleOAuthStart,
+		},
+		{
+			Method:      "GET",
+			Pattern:     "/auth/oauth/{provider}/callback",
+			HandlerFunc: c.handleOAuthCallback,
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/login/2fa",
+			HandlerFunc: c.handleLoginMFA,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.LoginMFARequest](),
+			},
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/verify-email",
+			HandlerFunc: c.handleVerifyEmail,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.VerifyEmailRequest](),
+			},
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/verify-email/resend",
+			HandlerFunc: c.handleResendVerification,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.ResendVerificationRequest](),
+			},
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/password/forgot",
+			HandlerFunc: c.handleForgotPassword,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.ForgotPasswordRequest](),
+			},
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/password/reset",
+			HandlerFunc: c.handleResetPassword,
+			Middlewares: []betools.Middleware{
+				betools.BodyParser[models.ResetPasswordRequest](),
+			},
+		},
+		{
+			Method:      "POST",
+			Pattern:     "/auth/refresh",
+			HandlerFunc: c.handleRefresh,
+		},
 		{
 			Method:      "POST",
 			Pattern:     "/auth/logout",
 			HandlerFunc: c.handleLogout,
 		},
 	}
+
+	routes = append(routes, betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "PUT",
+				Pattern:     "/admin/players/{uid}/roles",
+				HandlerFunc: c.handleSetRoles,
+				Middlewares: []betools.Middleware{
+					middlewares.RequireRole(models.RoleAdmin),
+					betools.BodyParser[models.SetRolesRequest](),
+				},
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/admin/players/{uid}/sessions",
+				HandlerFunc: c.handleAdminRevokeSessions,
+				Middlewares: []betools.Middleware{
+					middlewares.RequireRole(models.RoleAdmin, models.RoleModerator),
+				},
+			},
+		},
+	)...)
+
+	return append(routes, betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "PUT",
+				Pattern:     "/player/me/password",
+				HandlerFunc: c.handleChangePassword,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.ChangePasswordRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/auth/guest/upgrade",
+				HandlerFunc: c.handleUpgradeGuest,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.RegisterRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/auth/oauth/{provider}/link",
+				HandlerFunc: c.handleOAuthLink,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/auth/2fa/enroll",
+				HandlerFunc: c.handleEnrollTOTP,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/auth/2fa/confirm",
+				HandlerFunc: c.handleConfirmTOTP,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.TOTPConfirmRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/auth/2fa/disable",
+				HandlerFunc: c.handleDisableTOTP,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.TOTPDisableRequest](),
+				},
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/auth/sessions",
+				HandlerFunc: c.handleListSessions,
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/auth/sessions",
+				HandlerFunc: c.handleRevokeAllSessions,
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/auth/sessions/{id}",
+				HandlerFunc: c.handleRevokeSession,
+			},
+		},
+	)...)
 }
 
 func (c *Controller) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -63,27 +230,487 @@ func (c *Controller) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	slog.Debug("login", "email", req.Email)
 
-	res, err := c.svc.Login(req)
-	if err != nil {
+	res, err := c.svc.Login(req, ClientInfo(r))
+	var throttled *ThrottledError
+	var banned *models.BannedError
+	if errors.As(err, &throttled) {
+		slog.Error("login", "email", req.Email, "error", err)
+		SendThrottled(w, throttled)
+		return
+	} else if errors.As(err, &banned) {
+		slog.Error("login", "email", req.Email, "error", err)
+		middlewares.SendBanned(w, banned)
+		return
+	} else if errors.Is(err, ErrInvalidCredentials) {
+		slog.Error("login", "email", req.Email, "error", err)
+		betools.SendErrorResponse(w, http.StatusUnauthorized, "invalid email or password")
+		return
+	} else if errors.Is(err, ErrEmailNotVerified) {
+		slog.Error("login", "email", req.Email, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, "email not verified")
+		return
+	} else if err != nil {
 		slog.Error("login", "email", req.Email, "error", err)
 		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to login")
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     "refresh_token",
-		Value:    res.RefreshToken,
-		Expires:  res.ExpiresIn,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+	sendLoginResponse(w, res)
+}
+
+func (c *Controller) handleGuestLogin(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.GuestLoginRequest](r)
+
+	res, err := c.svc.GuestLogin(req, ClientInfo(r))
+	var throttled *ThrottledError
+	var banned *models.BannedError
+	if errors.As(err, &throttled) {
+		slog.Error("guest login", "error", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		betools.SendErrorResponse(w, http.StatusTooManyRequests, "too many guest accounts created")
+		return
+	} else if errors.As(err, &banned) {
+		slog.Error("guest login", "error", err)
+		middlewares.SendBanned(w, banned)
+		return
+	} else if err != nil {
+		slog.Error("guest login", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to login as guest")
+		return
+	}
+
+	sendLoginResponse(w, res)
+}
+
+func (c *Controller) handleUpgradeGuest(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.RegisterRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	if err := c.svc.UpgradeGuest(uid, req); errors.Is(err, ErrNotGuest) {
+		slog.Error("upgrade guest", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, "account is not a guest")
+		return
+	} else if err != nil {
+		slog.Error("upgrade guest", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to upgrade guest")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleOAuthStart(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+
+	authURL, binding, err := c.svc.StartOAuth(provider, 0)
+	if errors.Is(err, ErrUnknownProvider) {
+		slog.Error("oauth start", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "unknown provider")
+		return
+	} else if err != nil {
+		slog.Error("oauth start", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadGateway, "failed to start oauth")
+		return
+	}
+
+	setOAuthBindingCookie(w, binding)
+
+	betools.SendOKResponse(w, models.OAuthStartResponse{
+		AuthorizationURL: authURL,
+	})
+}
+
+func (c *Controller) handleOAuthLink(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	uid := betools.GetAuthCtx(r).UserID
+
+	authURL, binding, err := c.svc.StartOAuth(provider, uid)
+	if errors.Is(err, ErrUnknownProvider) {
+		slog.Error("oauth link", "provider", provider, "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "unknown provider")
+		return
+	} else if err != nil {
+		slog.Error("oauth link", "provider", provider, "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadGateway, "failed to start oauth")
+		return
+	}
+
+	setOAuthBindingCookie(w, binding)
+
+	betools.SendOKResponse(w, models.OAuthStartResponse{
+		AuthorizationURL: authURL,
+	})
+}
+
+func (c *Controller) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	query := r.URL.Query()
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		slog.Error("oauth callback", "provider", provider, "error", providerErr)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "provider denied login")
+		return
+	}
+
+	binding := ""
+	if cookie, err := r.Cookie(oauthBindingCookieName); err == nil {
+		binding = cookie.Value
+	}
+	clearOAuthBindingCookie(w)
+
+	res, linkedUID, err := c.svc.FinishOAuth(provider, query.Get("state"), query.Get("code"), binding, ClientInfo(r))
+	var banned *models.BannedError
+	if errors.Is(err, ErrIdentityEmailTaken) || errors.Is(err, ErrIdentityLinked) {
+		slog.Error("oauth callback", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if errors.Is(err, ErrIdentityUnverified) {
+		slog.Error("oauth callback", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, err)
+		return
+	} else if errors.Is(err, ErrEmailNotVerified) {
+		slog.Error("oauth callback", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, "email not verified")
+		return
+	} else if errors.As(err, &banned) {
+		slog.Error("oauth callback", "provider", provider, "error", err)
+		middlewares.SendBanned(w, banned)
+		return
+	} else if err != nil {
+		slog.Error("oauth callback", "provider", provider, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to login with provider")
+		return
+	}
+
+	if linkedUID != 0 {
+		slog.Info("identity linked", "provider", provider, "uid", linkedUID)
+		betools.SendOKResponse(w, "provider linked")
+		return
+	}
+
+	sendLoginResponse(w, res)
+}
+
+func (c *Controller) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.LoginMFARequest](r)
+
+	res, err := c.svc.LoginMFA(req, ClientInfo(r))
+	var throttled *ThrottledError
+	var banned *models.BannedError
+	if errors.As(err, &throttled) {
+		slog.Error("login mfa", "error", err)
+		SendThrottled(w, throttled)
+		return
+	} else if errors.Is(err, ErrInvalidMFACode) {
+		slog.Error("login mfa", "error", err)
+		betools.SendErrorResponse(w, http.StatusUnauthorized, "invalid code")
+		return
+	} else if errors.As(err, &banned) {
+		slog.Error("login mfa", "error", err)
+		middlewares.SendBanned(w, banned)
+		return
+	} else if err != nil {
+		slog.Error("login mfa", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to login")
+		return
+	}
+
+	sendLoginResponse(w, res)
+}
+
+func (c *Controller) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.EnrollTOTP(uid)
+	if err != nil {
+		slog.Error("enroll totp", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to enroll 2fa")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.TOTPConfirmRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.ConfirmTOTP(uid, req.Code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		slog.Error("confirm totp", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "invalid code")
+		return
+	} else if err != nil {
+		slog.Error("confirm totp", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to confirm 2fa")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.TOTPDisableRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	err := c.svc.DisableTOTP(uid, req.Password, req.Code)
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		slog.Error("disable totp", "uid", uid, "error", err)
+		SendThrottled(w, throttled)
+		return
+	} else if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrInvalidMFACode) {
+		slog.Error("disable totp", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, "wrong password or code")
+		return
+	} else if err != nil {
+		slog.Error("disable totp", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to disable 2fa")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.VerifyEmailRequest](r)
+
+	if err := c.svc.VerifyEmail(req.Token); err != nil {
+		slog.Error("verify email", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to verify email")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ResendVerificationRequest](r)
+
+	if err := c.svc.ResendVerificationEmail(req.Email); err != nil {
+		slog.Error("resend verification", "email", req.Email, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to resend verification")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ForgotPasswordRequest](r)
+
+	if err := c.svc.ForgotPassword(req.Email); err != nil {
+		slog.Error("forgot password", "email", req.Email, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to request password reset")
+		return
 	}
 
-	if env.C.IsProd {
-		cookie.Secure = true
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ResetPasswordRequest](r)
+
+	if err := c.svc.ResetPassword(req.Token, req.Password); err != nil {
+		slog.Error("reset password", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to reset password")
+		return
 	}
 
-	http.SetCookie(w, cookie)
+	clearRefreshCookie(w)
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ChangePasswordRequest](r)
+	auth := betools.GetAuthCtx(r)
+
+	if err := c.svc.ChangePassword(auth.UserID, auth.SessionID, req.CurrentPassword, req.NewPassword); errors.Is(err, ErrWrongPassword) {
+		slog.Error("change password", "uid", auth.UserID, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, "wrong password")
+		return
+	} else if err != nil {
+		slog.Error("change password", "uid", auth.UserID, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to change password")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil {
+		slog.Error("refresh", "error", err)
+		betools.SendErrorResponse(w, http.StatusUnauthorized, "missing refresh token")
+		return
+	}
+
+	res, err := c.svc.Refresh(cookie.Value, ClientInfo(r))
+	var banned *models.BannedError
+	if errors.As(err, &banned) {
+		slog.Error("refresh", "error", err)
+		middlewares.SendBanned(w, banned)
+		return
+	} else if err != nil {
+		slog.Error("refresh", "error", err)
+		clearRefreshCookie(w)
+		betools.SendErrorResponse(w, http.StatusUnauthorized, "failed to refresh")
+		return
+	}
+
+	sendLoginResponse(w, res)
+}
+
+func (c *Controller) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(refreshCookieName); err == nil {
+		if err := c.svc.Logout(cookie.Value); err != nil {
+			slog.Error("logout", "error", err)
+		}
+	}
+
+	clearRefreshCookie(w)
+
+	betools.SendOKResponse(w)
+}
+
+// handleJWKS serves the token verification keys as a bare JWK Set instead of
+// the usual response envelope, so standard JWT libraries can consume it.
+func (c *Controller) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwtkeys.K.JWKS())
+}
+
+func (c *Controller) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	var currentRefreshToken string
+	if cookie, err := r.Cookie(refreshCookieName); err == nil {
+		currentRefreshToken = cookie.Value
+	}
+
+	res, err := c.svc.ListSessions(uid, currentRefreshToken)
+	if err != nil {
+		slog.Error("list sessions", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list sessions")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	sessionID := chi.URLParam(r, "id")
+
+	if err := c.svc.RevokeSession(uid, sessionID); err != nil {
+		slog.Error("revoke session", "uid", uid, "session", sessionID, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke session")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	if err := c.svc.RevokeAllTokens(uid); err != nil {
+		slog.Error("revoke all sessions", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke sessions")
+		return
+	}
+
+	clearRefreshCookie(w)
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleSetRoles(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.SetRolesRequest](r)
+
+	uid, err := strconv.Atoi(chi.URLParam(r, "uid"))
+	if err != nil {
+		slog.Error("set roles", "uid", chi.URLParam(r, "uid"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to set roles")
+		return
+	}
+
+	if err := c.svc.SetRoles(uid, req.Roles); err != nil {
+		slog.Error("set roles", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to set roles")
+		return
+	}
+
+	slog.Info("roles changed", "uid", uid, "roles", req.Roles, "by", betools.GetAuthCtx(r).UserID)
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(chi.URLParam(r, "uid"))
+	if err != nil {
+		slog.Error("admin revoke sessions", "uid", chi.URLParam(r, "uid"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke sessions")
+		return
+	}
+
+	if err := c.svc.RevokeAllTokens(uid); err != nil {
+		slog.Error("admin revoke sessions", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to revoke sessions")
+		return
+	}
+
+	slog.Info("sessions revoked", "uid", uid, "by", betools.GetAuthCtx(r).UserID)
+
+	betools.SendOKResponse(w)
+}
+
+// SendThrottled answers 429 with when to retry, for the other packages
+// throttling with ThrottledError too.
+func SendThrottled(w http.ResponseWriter, err *ThrottledError) {
+	retryAfter := int(math.Ceil(err.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	code, message := "login_throttled", "too many failed logins, slow down"
+	if err.Locked {
+		code, message = "login_locked", "too many failed logins, temporarily locked"
+	}
+
+	betools.SendErrorCodeResponse(w, http.StatusTooManyRequests, code, message, map[string]int{
+		"retry_after_seconds": retryAfter,
+	})
+}
+
+// ClientInfo returns the address and user agent the request came from.
+func ClientInfo(r *http.Request) models.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return models.ClientInfo{
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+const refreshCookieName = "refresh_token"
+
+// sendLoginResponse sets the refresh cookie and returns the access token, or
+// only the mfa token when the login still needs a second factor.
+func sendLoginResponse(w http.ResponseWriter, res *models.LoginResult) {
+	if res.MFAToken != "" {
+		betools.SendOKResponse(w, models.LoginResponse{
+			MFARequired: true,
+			MFAToken:    res.MFAToken,
+		})
+		return
+	}
+
+	setRefreshCookie(w, res)
 
 	betools.SendOKResponse(w, models.LoginResponse{
 		AccessToken: res.AccessToken,
@@ -92,5 +719,55 @@ func (c *Controller) handleLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (c *Controller) handleLogout(w http.ResponseWriter, r *http.Request) {
+func setRefreshCookie(w http.ResponseWriter, res *models.LoginResult) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    res.RefreshToken,
+		Expires:  res.RefreshExpiresIn,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   env.C.IsProd,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   env.C.IsProd,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// oauthBindingCookieName ties an OAuth flow to the browser that started it.
+// It is Lax rather than Strict since the provider's redirect back to the
+// callback is a cross-site navigation.
+const oauthBindingCookieName = "oauth_binding"
+
+func setOAuthBindingCookie(w http.ResponseWriter, binding string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthBindingCookieName,
+		Value:    binding,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		Path:     "/auth/oauth/",
+		HttpOnly: true,
+		Secure:   env.C.IsProd,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearOAuthBindingCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthBindingCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/auth/oauth/",
+		HttpOnly: true,
+		Secure:   env.C.IsProd,
+		SameSite: http.SameSiteLaxMode,
+	})
 }
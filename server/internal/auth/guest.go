@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"server/internal/env"
+	"server/internal/models"
+	"server/internal/passhash"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// GuestLogin signs in the guest account bound to the device, creating it on
+// first use. The device ID is a client generated secret and only its hash is
+// stored, since anyone presenting it gets the account.
+func (s *Service) GuestLogin(req models.GuestLoginRequest, client models.ClientInfo) (*models.LoginResult, error) {
+	deviceHash := hashOpaqueToken(req.DeviceID)
+
+	var uid int
+	err := s.db.QueryRow(context.Background(),
+		"SELECT id FROM accounts WHERE device_id_hash = $1 AND is_guest",
+		deviceHash,
+	).Scan(&uid)
+	if err == pgx.ErrNoRows {
+		if err := s.checkGuestCreateLimit(client.IP); err != nil {
+			return nil, err
+		}
+
+		if err := s.db.QueryRow(context.Background(),
+			`WITH account AS (
+				INSERT INTO accounts (is_guest, device_id_hash) VALUES (TRUE, $1) RETURNING id
+			)
+			INSERT INTO player_profiles (account_id) SELECT id FROM account RETURNING account_id`,
+			deviceHash,
+		).Scan(&uid); err != nil {
+			return nil, fmt.Errorf("postgres insert: %w", err)
+		}
+
+		slog.Info("guest account created", "uid", uid)
+	} else if err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	return s.startSession(uid, req.Device, client)
+}
+
+func (s *Service) checkGuestCreateLimit(ip string) error {
+	key := "guest_create:" + ip
+
+	count, err := s.rdb.Incr(context.Background(), key).Result()
+	if err != nil {
+		return fmt.Errorf("redis incr: %w", err)
+	}
+	if count == 1 {
+		if err := s.rdb.Expire(context.Background(), key, time.Hour).Err(); err != nil {
+			return fmt.Errorf("redis expire: %w", err)
+		}
+	}
+
+	if count > int64(env.C.GuestMaxCreatesPerIPPerHour) {
+		ttl, err := s.rdb.PTTL(context.Background(), key).Result()
+		if err != nil {
+			return fmt.Errorf("redis pttl: %w", err)
+		}
+		return &ThrottledError{RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+// UpgradeGuest turns a guest into a full account in place, keeping its ID
+// and everything attached to it. The device binding is dropped, from now on
+// the player logs in with email and password.
+func (s *Service) UpgradeGuest(uid int, req models.RegisterRequest) error {
+	req.Email = strings.ToLower(req.Email)
+
+	passHash, err := passhash.Hash(req.Password)
+	if err != nil {
+		return err
+	}
+
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET first_name = $1, last_name = $2, email = $3, password_hash = $4, is_guest = FALSE, device_id_hash = NULL WHERE id = $5 AND is_guest",
+		req.FirstName, req.LastName, req.Email, passHash, uid)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("user already exists")
+		}
+
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotGuest
+	}
+
+	// the profile falls back to the first name the guest just gave
+	if err := s.rdb.Del(context.Background(), fmt.Sprintf("account:%d", uid), fmt.Sprintf("profile:%d", uid)).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	// access tokens still carry the guest claim, make the client refresh
+	if err := s.revokeAccessTokens(uid); err != nil {
+		return fmt.Errorf("revoke access tokens: %w", err)
+	}
+
+	if err := s.sendVerificationEmail(uid, req.Email); err != nil {
+		slog.Error("send verification email", "uid", uid, "error", err)
+	}
+
+	return nil
+}
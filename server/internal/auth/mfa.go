@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"server/internal/env"
+	"server/internal/models"
+	"server/internal/throttle"
+	"server/internal/totp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mfaPendingTTL       = 5 * time.Minute
+	totpEnrollTTL       = 10 * time.Minute
+	recoveryCodeCount   = 10
+	totpIssuer          = "multiplayer-game-server"
+	mfaPendingTokenKind = "mfa_pending"
+)
+
+// startMFA is the first step of a login with 2FA enabled: instead of tokens
+// the client gets a short-lived mfa_pending token to present with a code.
+func (s *Service) startMFA(uid int) (*models.LoginResult, error) {
+	// refuse before asking for a code that could not get them in anyway
+	if err := s.bans.CheckBan(uid); err != nil {
+		return nil, err
+	}
+	if err := s.checkMFAThrottle(uid); err != nil {
+		return nil, err
+	}
+
+	token, err := s.issueOpaqueToken(mfaPendingTokenKind, uid, mfaPendingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("issue token: %w", err)
+	}
+
+	return &models.LoginResult{
+		UserID:   uid,
+		MFAToken: token,
+	}, nil
+}
+
+// LoginMFA completes a login started by Login with either a TOTP code or a
+// recovery code. Attempts are counted per account, not per pending token,
+// since logging in again hands out a new token.
+func (s *Service) LoginMFA(req models.LoginMFARequest, client models.ClientInfo) (*models.LoginResult, error) {
+	uid, err := s.peekOpaqueToken(mfaPendingTokenKind, req.MFAToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.startMFAAttempt(uid); err != nil {
+		return nil, err
+	}
+
+	if req.RecoveryCode != "" {
+		err = s.useRecoveryCode(uid, req.RecoveryCode)
+	} else {
+		err = s.checkTOTP(uid, req.Code)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clearMFAAttempts(uid); err != nil {
+		return nil, err
+	}
+
+	// consuming the token makes a concurrent second completion fail
+	if _, err := s.consumeOpaqueToken(mfaPendingTokenKind, req.MFAToken); err != nil {
+		return nil, err
+	}
+
+	return s.startSession(uid, req.Device, client)
+}
+
+// checkMFAThrottle refuses codes while the account is locked out after
+// MFAMaxFailures wrong codes within MFAFailureWindowSeconds.
+func (s *Service) checkMFAThrottle(uid int) error {
+	ttl, err := s.rdb.PTTL(context.Background(), fmt.Sprintf("mfa_lock:%d", uid)).Result()
+	if err != nil {
+		return fmt.Errorf("redis pttl: %w", err)
+	}
+	if ttl > 0 {
+		return &ThrottledError{Locked: true, RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+// startMFAAttempt counts a code about to be checked at mfa_fail:<uid>,
+// before checking it so parallel guesses cannot get past MFAMaxFailures. Past
+// the max the account is locked out at mfa_lock:<uid>.
+func (s *Service) startMFAAttempt(uid int) error {
+	wait, err := throttle.Attempt(s.rdb,
+		fmt.Sprintf("mfa_fail:%d", uid), fmt.Sprintf("mfa_lock:%d", uid),
+		time.Duration(env.C.MFAFailureWindowSeconds)*time.Second, env.C.MFAMaxFailures,
+		time.Duration(env.C.MFALockoutSeconds)*time.Second,
+	)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &ThrottledError{Locked: true, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// clearMFAAttempts forgets the attempts once a code was right.
+func (s *Service) clearMFAAttempts(uid int) error {
+	if err := s.rdb.Del(context.Background(), fmt.Sprintf("mfa_fail:%d", uid)).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	return nil
+}
+
+// EnrollTOTP generates a secret the player adds to their authenticator app.
+// 2FA is only turned on once ConfirmTOTP receives a valid code for it.
+func (s *Service) EnrollTOTP(uid int) (*models.TOTPEnrollResponse, error) {
+	var email string
+	var enabled bool
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT email, totp_enabled_at IS NOT NULL FROM accounts WHERE id = $1",
+		uid,
+	).Scan(&email, &enabled); err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	if enabled {
+		return nil, fmt.Errorf("2fa already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("generate secret: %w", err)
+	}
+
+	if err := s.rdb.Set(context.Background(), fmt.Sprintf("totp_pending:%d", uid), secret, totpEnrollTTL).Err(); err != nil {
+		return nil, fmt.Errorf("redis set: %w", err)
+	}
+
+	return &models.TOTPEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: totp.URI(totpIssuer, email, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables 2FA and returns freshly generated recovery codes. They
+// are only stored hashed, so this is the only time they can be shown.
+func (s *Service) ConfirmTOTP(uid int, code string) (*models.TOTPConfirmResponse, error) {
+	pendingKey := fmt.Sprintf("totp_pending:%d", uid)
+
+	secret, err := s.rdb.Get(context.Background(), pendingKey).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("no pending 2fa enrollment")
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	}
+
+	if _, ok := totp.Validate(secret, code, time.Now()); !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := genRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("gen recovery codes: %w", err)
+	}
+
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET totp_secret = $1, totp_enabled_at = NOW(), totp_recovery_codes = $2 WHERE id = $3 AND totp_enabled_at IS NULL",
+		secret, hashes, uid)
+	if err != nil {
+		return nil, fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("2fa already enabled")
+	}
+
+	if err := s.rdb.Del(context.Background(), pendingKey).Err(); err != nil {
+		return nil, fmt.Errorf("redis del: %w", err)
+	}
+
+	return &models.TOTPConfirmResponse{
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// DisableTOTP turns 2FA off, requiring a current code and the password.
+// Accounts without a password, such as social logins, only give the code.
+// Attempts count towards the same lockout as logins.
+func (s *Service) DisableTOTP(uid int, password string, code string) error {
+	var passHash string
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT COALESCE(password_hash, '') FROM accounts WHERE id = $1",
+		uid,
+	).Scan(&passHash); err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	if err := s.startMFAAttempt(uid); err != nil {
+		return err
+	}
+
+	if passHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(passHash), []byte(password)); err != nil {
+			return ErrWrongPassword
+		}
+	}
+
+	if err := s.checkTOTP(uid, code); err != nil {
+		return err
+	}
+
+	if err := s.clearMFAAttempts(uid); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET totp_secret = NULL, totp_enabled_at = NULL, totp_recovery_codes = '{}' WHERE id = $1",
+		uid); err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+
+	return nil
+}
+
+// checkTOTP validates a code against the account's secret. Each time step
+// can only be used once so an observed code cannot be replayed.
+func (s *Service) checkTOTP(uid int, code string) error {
+	var secret *string
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT totp_secret FROM accounts WHERE id = $1 AND totp_enabled_at IS NOT NULL",
+		uid,
+	).Scan(&secret); err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+	if secret == nil {
+		return fmt.Errorf("2fa not enabled")
+	}
+
+	step, ok := totp.Validate(*secret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	fresh, err := s.rdb.SetNX(context.Background(),
+		fmt.Sprintf("totp_used:%d:%d", uid, step), 1, 2*time.Minute,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("redis setnx: %w", err)
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+func (s *Service) useRecoveryCode(uid int, code string) error {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET totp_recovery_codes = array_remove(totp_recovery_codes, $1) WHERE id = $2 AND $1 = ANY(totp_recovery_codes)",
+		hashOpaqueToken(normalizeRecoveryCode(code)), uid)
+	if err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// genRecoveryCodes returns codes formatted as XXXX-XXXX-XXXX-XXXX (80 bits)
+// and their hashes. Hashing the normalized form lets players type them in
+// lowercase or without dashes.
+func genRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for range recoveryCodeCount {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("rand read: %w", err)
+		}
+
+		raw := base32.StdEncoding.EncodeToString(b)
+		code := strings.Join([]string{raw[0:4], raw[4:8], raw[8:12], raw[12:16]}, "-")
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashOpaqueToken(normalizeRecoveryCode(code)))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
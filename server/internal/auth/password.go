@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"server/internal/env"
+	"server/internal/mailer"
+	"server/internal/models"
+	"server/internal/passhash"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ForgotPassword mails a single-use reset token to the account. Like
+// ResendVerificationEmail it succeeds whether or not the address exists.
+func (s *Service) ForgotPassword(email string) error {
+	email = strings.ToLower(email)
+
+	var uid int
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT id FROM accounts WHERE email = $1",
+		email,
+	).Scan(&uid); err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	ok, err := s.rdb.SetNX(context.Background(),
+		fmt.Sprintf("password_reset_resend:%d", uid), 1,
+		time.Duration(env.C.PasswordResetResendSeconds)*time.Second,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("redis setnx: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	ttl := time.Duration(env.C.PasswordResetTokenSeconds) * time.Second
+
+	token, err := s.issueOpaqueToken("password_reset", uid, ttl)
+	if err != nil {
+		return fmt.Errorf("issue token: %w", err)
+	}
+
+	if err := s.mailer.Send(mailer.Mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use the following code to reset your password:\n\n%s\n\nThe code expires in %s. If you did not ask for a reset, you can ignore this mail.",
+			token, ttl),
+	}); err != nil {
+		return fmt.Errorf("mailer send: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and logs the
+// account out everywhere.
+func (s *Service) ResetPassword(token string, newPassword string) error {
+	uid, err := s.consumeOpaqueToken("password_reset", token)
+	if err != nil {
+		return err
+	}
+
+	if err := s.setPassword(uid, newPassword); err != nil {
+		return err
+	}
+
+	if err := s.RevokeAllTokens(uid); err != nil {
+		return fmt.Errorf("revoke all tokens: %w", err)
+	}
+
+	return nil
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// session except the caller's is logged out.
+func (s *Service) ChangePassword(uid int, sessionID string, currentPassword string, newPassword string) error {
+	var passHash string
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT password_hash FROM accounts WHERE id = $1",
+		uid,
+	).Scan(&passHash); err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passHash), []byte(currentPassword)); err != nil {
+		return ErrWrongPassword
+	}
+
+	if err := s.setPassword(uid, newPassword); err != nil {
+		return err
+	}
+
+	if err := s.revokeOtherSessions(uid, sessionID); err != nil {
+		return fmt.Errorf("revoke other sessions: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) setPassword(uid int, password string) error {
+	passHash, err := passhash.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET password_hash = $1 WHERE id = $2",
+		passHash, uid); err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+
+	return nil
+}
+
+// StepUp confirms a sensitive action on top of the access token: with the
+// password and a 2FA code on accounts having them, throttled like logins.
+// Accounts with neither, guests and social logins, must have logged in within
+// StepUpMaxAgeSeconds instead.
+func (s *Service) StepUp(uid int, sessionID string, password string, code string, client models.ClientInfo) error {
+	var email, passHash string
+	var totpEnabled bool
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT COALESCE(email, ''), COALESCE(password_hash, ''), totp_enabled_at IS NOT NULL FROM accounts WHERE id = $1",
+		uid,
+	).Scan(&email, &passHash, &totpEnabled); err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	if passHash != "" {
+		if err := s.checkLoginThrottle(email, client.IP); err != nil {
+			return err
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(passHash), []byte(password)); err != nil {
+			if err := s.recordLoginFailure(email, client.IP); err != nil {
+				return fmt.Errorf("record login failure: %w", err)
+			}
+			return ErrWrongPassword
+		}
+		if err := s.clearLoginFailures(email); err != nil {
+			return fmt.Errorf("clear login failures: %w", err)
+		}
+	}
+
+	if totpEnabled {
+		if code == "" {
+			return ErrMFACodeRequired
+		}
+		if err := s.startMFAAttempt(uid); err != nil {
+			return err
+		}
+		if err := s.checkTOTP(uid, code); err != nil {
+			return err
+		}
+		return s.clearMFAAttempts(uid)
+	}
+
+	if passHash == "" {
+		session, err := s.getSession(sessionID)
+		if err == redis.Nil {
+			return ErrReauthRequired
+		} else if err != nil {
+			return fmt.Errorf("get session: %w", err)
+		}
+		if time.Since(session.CreatedAt) > time.Duration(env.C.StepUpMaxAgeSeconds)*time.Second {
+			return ErrReauthRequired
+		}
+	}
+
+	return nil
+}
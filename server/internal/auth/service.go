@@ -3,10 +3,17 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"server/internal/enforcement"
 	"server/internal/env"
+	"server/internal/jwtkeys"
+	"server/internal/mailer"
 	"server/internal/models"
+	"server/internal/passhash"
+	"server/pkg/betools"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,36 +21,56 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailNotVerified   = errors.New("email not verified")
+	ErrWrongPassword      = errors.New("wrong password")
+	ErrInvalidMFACode     = errors.New("invalid mfa code")
+	ErrMFACodeRequired    = errors.New("2fa code required")
+	ErrReauthRequired     = errors.New("log in again to confirm")
+	ErrNotGuest           = errors.New("account is not a guest")
+)
+
 type Service struct {
-	rdb *redis.Client
-	db  *pgx.Conn
+	rdb       *redis.Client
+	db        *pgxpool.Pool
+	mailer    mailer.Mailer
+	providers map[string]Provider
+	bans      *enforcement.Service
 }
 
-func NewService(db *pgx.Conn, rdb *redis.Client) *Service {
+func NewService(db *pgxpool.Pool, rdb *redis.Client, m mailer.Mailer, providers map[string]Provider, bans *enforcement.Service) *Service {
 	return &Service{
-		rdb: rdb,
-		db:  db,
+		rdb:       rdb,
+		db:        db,
+		mailer:    m,
+		providers: providers,
+		bans:      bans,
 	}
 }
 
 func (s *Service) Register(req models.RegisterRequest) error {
 	req.Email = strings.ToLower(req.Email)
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), 12)
+	passHash, err := passhash.Hash(req.Password)
 	if err != nil {
-		return fmt.Errorf("bcrypt generate: %w", err)
+		return err
 	}
-	slog.Debug("hashing password with bcrypt", "password", req.Password, "hash", string(passHash))
 
-	if _, err := s.db.Exec(context.Background(),
-		"INSERT INTO accounts (first_name, last_name, email, password_hash) VALUES ($1, $2, $3, $4)",
-		req.FirstName, req.LastName, req.Email, string(passHash)); err != nil {
+	// the public profile starts out showing the first name only
+	var uid int
+	if err := s.db.QueryRow(context.Background(),
+		`WITH account AS (
+			INSERT INTO accounts (first_name, last_name, email, password_hash) VALUES ($1, $2, $3, $4) RETURNING id
+		)
+		INSERT INTO player_profiles (account_id, display_name) SELECT id, LEFT($1, 32) FROM account RETURNING account_id`,
+		req.FirstName, req.LastName, req.Email, passHash).Scan(&uid); err != nil {
 
 		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
 			return fmt.Errorf("user already exists")
@@ -52,73 +79,310 @@ func (s *Service) Register(req models.RegisterRequest) error {
 		return fmt.Errorf("postgres insert: %w", err)
 	}
 
+	// the account exists at this point, a failed mail can be resent later
+	if err := s.sendVerificationEmail(uid, req.Email); err != nil {
+		slog.Error("send verification email", "uid", uid, "error", err)
+	}
+
 	return nil
 }
 
-func (s *Service) Login(req models.LoginRequest) (*models.LoginResult, error) {
+func (s *Service) Login(req models.LoginRequest, client models.ClientInfo) (*models.LoginResult, error) {
 	type userType struct {
-		ID           int
-		PasswordHash string
+		ID            int
+		PasswordHash  string
+		EmailVerified bool
+		TOTPEnabled   bool
+	}
+
+	req.Email = strings.ToLower(req.Email)
+
+	if err := s.checkLoginThrottle(req.Email, client.IP); err != nil {
+		return nil, err
 	}
 
 	user := userType{}
-	if err := pgxscan.Get(context.Background(), s.db, &user,
-		"SELECT id, password_hash FROM accounts WHERE email = $1",
+	err := pgxscan.Get(context.Background(), s.db, &user,
+		"SELECT id, COALESCE(password_hash, '') AS password_hash, email_verified_at IS NOT NULL AS email_verified, totp_enabled_at IS NOT NULL AS totp_enabled FROM accounts WHERE email = $1",
 		req.Email,
-	); err != nil {
+	)
+	if err != nil && !pgxscan.NotFound(err) {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+	// accounts created through social login have no password
+	found := err == nil && user.PasswordHash != ""
+
+	// unknown emails are checked against a dummy hash so both failures take
+	// the same time and cannot be told apart
+	passHash := dummyPasswordHash
+	if found {
+		passHash = []byte(user.PasswordHash)
+	}
 
-		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.NoDataFound {
-			return nil, fmt.Errorf("user not found")
+	if err := bcrypt.CompareHashAndPassword(passHash, []byte(req.Password)); err != nil || !found {
+		if err := s.recordLoginFailure(req.Email, client.IP); err != nil {
+			return nil, fmt.Errorf("record login failure: %w", err)
 		}
+		return nil, ErrInvalidCredentials
+	}
 
-		return nil, fmt.Errorf("postgres select: %w", err)
+	if err := s.clearLoginFailures(req.Email); err != nil {
+		return nil, fmt.Errorf("clear login failures: %w", err)
+	}
+
+	if env.C.EmailVerificationPolicy == env.EmailVerificationLogin && !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	if user.TOTPEnabled {
+		return s.startMFA(user.ID)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		return nil, fmt.Errorf("wrong password")
+	return s.startSession(user.ID, req.Device, client)
+}
+
+// startSession opens a new session (token family) and issues its first pair.
+func (s *Service) startSession(uid int, device string, client models.ClientInfo) (*models.LoginResult, error) {
+	familyID := uuid.NewString()
+	if err := s.createSession(uid, familyID, device, client); err != nil {
+		return nil, fmt.Errorf("create session: %w", err)
 	}
 
-	newAccessToken, err := genAccessToken(user.ID)
+	return s.issueTokens(uid, familyID)
+}
+
+// SetRoles replaces the roles of an account. Outstanding access tokens are
+// revoked so the new roles take effect on the player's next refresh.
+func (s *Service) SetRoles(uid int, roles []string) error {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET roles = $1 WHERE id = $2",
+		roles, uid)
+	if err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return s.revokeAccessTokens(uid)
+}
+
+// rotateRefreshScript atomically consumes refresh:<jti> (KEYS[1]) and leaves a
+// refresh_rotated:<jti> marker (KEYS[2]) holding the same value, so a second
+// presentation of the token can be told apart from an unknown one.
+var rotateRefreshScript = redis.NewScript(`
+local val = redis.call("GET", KEYS[1])
+if val then
+	local ttl = redis.call("PTTL", KEYS[1])
+	redis.call("DEL", KEYS[1])
+	if ttl > 0 then
+		redis.call("SET", KEYS[2], val, "PX", ttl)
+	end
+	return {"rotated", val}
+end
+
+local rotated = redis.call("GET", KEYS[2])
+if rotated then
+	return {"reused", rotated}
+end
+
+return false
+`)
+
+// Refresh exchanges a valid refresh token for a new access + refresh pair in
+// the same token family. Presenting a token that was already rotated revokes
+// the whole family, since either the client or an attacker holds a stale copy.
+func (s *Service) Refresh(refreshToken string, client models.ClientInfo) (*models.LoginResult, error) {
+	claims, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("parse refresh token: %w", err)
+	}
+
+	// checked before rotating, so the token still works once the ban is over
+	uid, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("parse subject: %w", err)
+	}
+	if err := s.bans.CheckBan(uid); err != nil {
+		return nil, err
+	}
+
+	res, err := rotateRefreshScript.Run(context.Background(), s.rdb,
+		[]string{"refresh:" + claims.ID, "refresh_rotated:" + claims.ID},
+	).StringSlice()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("refresh token revoked")
+	} else if err != nil {
+		return nil, fmt.Errorf("redis rotate refresh: %w", err)
+	}
+
+	cacheVal := models.RefreshTokenCacheVal{}
+	if err := json.Unmarshal([]byte(res[1]), &cacheVal); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	if fmt.Sprintf("%d", cacheVal.UserID) != claims.Subject {
+		return nil, fmt.Errorf("refresh token subject mismatch")
+	}
+
+	if res[0] == "reused" {
+		slog.Warn("security event",
+			"event", "refresh_token_reuse",
+			"uid", cacheVal.UserID,
+			"family", cacheVal.FamilyID,
+			"jti", claims.ID,
+		)
+
+		if err := s.revokeFamily(cacheVal.UserID, cacheVal.FamilyID); err != nil {
+			return nil, fmt.Errorf("revoke family: %w", err)
+		}
+
+		return nil, fmt.Errorf("refresh token reused")
+	}
+
+	if err := s.touchSession(cacheVal.UserID, cacheVal.FamilyID, client); err != nil {
+		return nil, fmt.Errorf("touch session: %w", err)
+	}
+
+	return s.issueTokens(cacheVal.UserID, cacheVal.FamilyID)
+}
+
+// Logout revokes the token family of the given refresh token. Unknown or
+// already revoked tokens are not treated as an error.
+func (s *Service) Logout(refreshToken string) error {
+	claims, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return fmt.Errorf("parse refresh token: %w", err)
+	}
+
+	cacheValJson, err := s.rdb.Get(context.Background(), "refresh:"+claims.ID).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("redis get: %w", err)
+	}
+
+	cacheVal := models.RefreshTokenCacheVal{}
+	if err := json.Unmarshal([]byte(cacheValJson), &cacheVal); err != nil {
+		return fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	if err := s.revokeFamily(cacheVal.UserID, cacheVal.FamilyID); err != nil {
+		return fmt.Errorf("revoke family: %w", err)
+	}
+
+	return nil
+}
+
+// revokeFamily deletes every live refresh token issued in the family along
+// with its session, and marks the session revoked so access tokens already
+// issued for it are rejected by AuthMiddleware. The refresh_rotated:* markers
+// are kept so later replays are still reported.
+func (s *Service) revokeFamily(uid int, familyID string) error {
+	familyKey := "refresh_family:" + familyID
+
+	jtis, err := s.rdb.SMembers(context.Background(), familyKey).Result()
+	if err != nil {
+		return fmt.Errorf("redis smembers: %w", err)
+	}
+
+	keys := append(betools.SliceMap(jtis, func(jti string) string {
+		return "refresh:" + jti
+	}), familyKey, "session:"+familyID)
+
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), keys...)
+		pipe.SRem(context.Background(), fmt.Sprintf("sessions:%d", uid), familyID)
+		pipe.Set(context.Background(), "access_revoked_session:"+familyID, 1, time.Duration(env.C.AccessTokenExpirationSeconds)*time.Second)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) issueTokens(uid int, familyID string) (*models.LoginResult, error) {
+	// every way of getting tokens ends up here
+	if err := s.bans.CheckBan(uid); err != nil {
+		return nil, err
+	}
+
+	// claims are read on every issue so account changes apply on the next refresh
+	account := tokenAccount{}
+	if err := pgxscan.Get(context.Background(), s.db, &account,
+		"SELECT roles, email_verified_at IS NOT NULL AS email_verified, is_guest AS guest FROM accounts WHERE id = $1",
+		uid,
+	); err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	newAccessToken, err := genAccessToken(uid, familyID, account)
 	if err != nil {
 		return nil, fmt.Errorf("jwt generate: %w", err)
 	}
 
-	newRefreshToken, refreshTokenJwtID, err := genRefreshToken(user.ID)
+	newRefreshToken, refreshTokenJwtID, err := genRefreshToken(uid)
 	if err != nil {
 		return nil, fmt.Errorf("refresh token generate: %w", err)
 	}
 
+	refreshTTL := time.Duration(env.C.RefreshTokenExpirationSeconds) * time.Second
+
 	cacheKey := "refresh:" + refreshTokenJwtID
 	cacheVal := models.RefreshTokenCacheVal{
-		UserID:    user.ID,
-		ExpiresIn: time.Now().Add(30 * 24 * time.Hour),
+		UserID:    uid,
+		FamilyID:  familyID,
+		ExpiresIn: time.Now().Add(refreshTTL),
 	}
 	cacheValBytes, err := json.Marshal(cacheVal)
 	if err != nil {
 		return nil, fmt.Errorf("json marshal: %w", err)
 	}
 
-	if err := s.rdb.Set(context.Background(), cacheKey, cacheValBytes, 30*24*time.Hour).Err(); err != nil {
+	familyKey := "refresh_family:" + familyID
+
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.Background(), cacheKey, cacheValBytes, refreshTTL)
+		pipe.SAdd(context.Background(), familyKey, refreshTokenJwtID)
+		pipe.Expire(context.Background(), familyKey, refreshTTL)
+		return nil
+	}); err != nil {
 		return nil, fmt.Errorf("redis set: %w", err)
 	}
 
 	return &models.LoginResult{
-		AccessToken:  newAccessToken,
-		RefreshToken: newRefreshToken,
-		UserID:       user.ID,
-		ExpiresIn:    time.Now().Add(time.Duration(env.C.AccessTokenExpirationSeconds) * time.Second),
+		AccessToken:      newAccessToken,
+		RefreshToken:     newRefreshToken,
+		UserID:           uid,
+		ExpiresIn:        time.Now().Add(time.Duration(env.C.AccessTokenExpirationSeconds) * time.Second),
+		RefreshExpiresIn: cacheVal.ExpiresIn,
 	}, nil
 }
 
-func genAccessToken(uid int) (string, error) {
-	claims := jwt.RegisteredClaims{
-		Issuer:    "multiplayer-game-server",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(env.C.AccessTokenExpirationSeconds) * time.Second)),
-		Subject:   fmt.Sprintf("%d", uid),
+// tokenAccount is the account state embedded into access tokens.
+type tokenAccount struct {
+	Roles         []string
+	EmailVerified bool
+	Guest         bool
+}
+
+func genAccessToken(uid int, sessionID string, account tokenAccount) (string, error) {
+	claims := models.AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "multiplayer-game-server",
+			Audience:  jwt.ClaimStrings{models.TokenAudienceAccess},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(env.C.AccessTokenExpirationSeconds) * time.Second)),
+			Subject:   fmt.Sprintf("%d", uid),
+		},
+		SessionID:     sessionID,
+		Roles:         account.Roles,
+		EmailVerified: account.EmailVerified,
+		Guest:         account.Guest,
 	}
 
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(env.C.JWTSecret))
+	return jwtkeys.K.Sign(claims)
 }
 
 func genRefreshToken(uid int) (string, string, error) {
@@ -126,16 +390,35 @@ func genRefreshToken(uid int) (string, string, error) {
 
 	claims := jwt.RegisteredClaims{
 		Issuer:    "multiplayer-game-server",
+		Audience:  jwt.ClaimStrings{models.TokenAudienceRefresh},
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(env.C.RefreshTokenExpirationSeconds) * time.Second)),
 		Subject:   fmt.Sprintf("%d", uid),
 		ID:        jti,
 	}
 
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(env.C.JWTSecret))
+	token, err := jwtkeys.K.Sign(claims)
 	if err != nil {
 		return "", "", fmt.Errorf("jwt generate: %w", err)
 	}
 
 	return token, jti, nil
 }
+
+// parseRefreshToken rejects access tokens, which carry another audience.
+func parseRefreshToken(refreshToken string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(refreshToken, claims, jwtkeys.K.Keyfunc,
+		jwt.WithAudience(models.TokenAudienceRefresh),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.ID == "" {
+		return nil, fmt.Errorf("token invalid")
+	}
+
+	return claims, nil
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), 12)
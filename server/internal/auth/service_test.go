@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"server/internal/env"
+	"server/internal/jwtkeys"
+	"testing"
+)
+
+func loadTestKeys(t *testing.T) {
+	t.Helper()
+
+	env.C = &env.Env{
+		JWTKeysDir:                    t.TempDir(),
+		AccessTokenExpirationSeconds:  300,
+		RefreshTokenExpirationSeconds: 600,
+	}
+	if err := jwtkeys.Load(); err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+}
+
+func TestParseRefreshToken(t *testing.T) {
+	loadTestKeys(t)
+
+	refreshToken, jti, err := genRefreshToken(42)
+	if err != nil {
+		t.Fatalf("gen refresh token: %v", err)
+	}
+	claims, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		t.Fatalf("refresh token rejected: %v", err)
+	}
+	if claims.ID != jti || claims.Subject != "42" {
+		t.Fatalf("got jti %q sub %q, want %q 42", claims.ID, claims.Subject, jti)
+	}
+
+	accessToken, err := genAccessToken(42, "family", tokenAccount{})
+	if err != nil {
+		t.Fatalf("gen access token: %v", err)
+	}
+	if _, err := parseRefreshToken(accessToken); err == nil {
+		t.Fatal("access token accepted as a refresh token")
+	}
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"server/internal/env"
+	"server/internal/models"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A session is the metadata of one refresh token family. It lives at
+// session:<familyID> and is indexed per account in the sessions:<uid> set.
+
+func (s *Service) createSession(uid int, familyID string, device string, client models.ClientInfo) error {
+	now := time.Now()
+
+	return s.saveSession(uid, models.Session{
+		ID:         familyID,
+		Device:     device,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	})
+}
+
+func (s *Service) touchSession(uid int, familyID string, client models.ClientInfo) error {
+	session, err := s.getSession(familyID)
+	if err == redis.Nil {
+		// session metadata can be missing for families created before
+		// sessions were tracked, recreate it instead of failing the refresh
+		return s.createSession(uid, familyID, "", client)
+	} else if err != nil {
+		return err
+	}
+
+	session.IP = client.IP
+	session.UserAgent = client.UserAgent
+	session.LastUsedAt = time.Now()
+
+	return s.saveSession(uid, *session)
+}
+
+func (s *Service) saveSession(uid int, session models.Session) error {
+	sessionBytes, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	refreshTTL := time.Duration(env.C.RefreshTokenExpirationSeconds) * time.Second
+	indexKey := fmt.Sprintf("sessions:%d", uid)
+
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.Background(), "session:"+session.ID, sessionBytes, refreshTTL)
+		pipe.SAdd(context.Background(), indexKey, session.ID)
+		pipe.Expire(context.Background(), indexKey, refreshTTL)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) getSession(familyID string) (*models.Session, error) {
+	sessionJson, err := s.rdb.Get(context.Background(), "session:"+familyID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	session := models.Session{}
+	if err := json.Unmarshal([]byte(sessionJson), &session); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	return &session, nil
+}
+
+// ListSessions returns the active sessions of an account, most recently used
+// first. currentRefreshToken, if valid, marks the caller's own session.
+func (s *Service) ListSessions(uid int, currentRefreshToken string) ([]models.Session, error) {
+	indexKey := fmt.Sprintf("sessions:%d", uid)
+
+	familyIDs, err := s.rdb.SMembers(context.Background(), indexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis smembers: %w", err)
+	}
+
+	currentFamilyID := s.familyOf(currentRefreshToken)
+
+	sessions := []models.Session{}
+	for _, familyID := range familyIDs {
+		session, err := s.getSession(familyID)
+		if err == redis.Nil {
+			// expired session, drop it from the index
+			if err := s.rdb.SRem(context.Background(), indexKey, familyID).Err(); err != nil {
+				return nil, fmt.Errorf("redis srem: %w", err)
+			}
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("get session: %w", err)
+		}
+
+		session.Current = familyID == currentFamilyID
+		sessions = append(sessions, *session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession logs out a single session of the account.
+func (s *Service) RevokeSession(uid int, sessionID string) error {
+	ok, err := s.rdb.SIsMember(context.Background(), fmt.Sprintf("sessions:%d", uid), sessionID).Result()
+	if err != nil {
+		return fmt.Errorf("redis sismember: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("session not found")
+	}
+
+	return s.revokeFamily(uid, sessionID)
+}
+
+// RevokeAllSessions logs the account out everywhere.
+func (s *Service) RevokeAllSessions(uid int) error {
+	indexKey := fmt.Sprintf("sessions:%d", uid)
+
+	familyIDs, err := s.rdb.SMembers(context.Background(), indexKey).Result()
+	if err != nil {
+		return fmt.Errorf("redis smembers: %w", err)
+	}
+
+	for _, familyID := range familyIDs {
+		if err := s.revokeFamily(uid, familyID); err != nil {
+			return fmt.Errorf("revoke family: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// revokeOtherSessions logs out every session of the account except keepID.
+func (s *Service) revokeOtherSessions(uid int, keepID string) error {
+	familyIDs, err := s.rdb.SMembers(context.Background(), fmt.Sprintf("sessions:%d", uid)).Result()
+	if err != nil {
+		return fmt.Errorf("redis smembers: %w", err)
+	}
+
+	for _, familyID := range familyIDs {
+		if familyID == keepID {
+			continue
+		}
+		if err := s.revokeFamily(uid, familyID); err != nil {
+			return fmt.Errorf("revoke family: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RevokeAllTokens logs the account out everywhere and invalidates every
+// access token issued to it so far, even ones not bound to a session.
+func (s *Service) RevokeAllTokens(uid int) error {
+	if err := s.RevokeAllSessions(uid); err != nil {
+		return fmt.Errorf("revoke all sessions: %w", err)
+	}
+
+	return s.revokeAccessTokens(uid)
+}
+
+// revokeAccessTokens rejects every access token issued to the account so far.
+// Sessions are left alone, so clients can still refresh into a new token. The
+// cutoff is in Unix seconds like iat, and tokens issued during that second
+// are revoked too; a client refreshing right away may have to refresh again.
+func (s *Service) revokeAccessTokens(uid int) error {
+	if err := s.rdb.Set(context.Background(),
+		fmt.Sprintf("access_valid_after:%d", uid), time.Now().Unix(),
+		time.Duration(env.C.AccessTokenExpirationSeconds)*time.Second,
+	).Err(); err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) familyOf(refreshToken string) string {
+	if refreshToken == "" {
+		return ""
+	}
+
+	claims, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return ""
+	}
+
+	cacheValJson, err := s.rdb.Get(context.Background(), "refresh:"+claims.ID).Result()
+	if err != nil {
+		return ""
+	}
+
+	cacheVal := models.RefreshTokenCacheVal{}
+	if err := json.Unmarshal([]byte(cacheValJson), &cacheVal); err != nil {
+		return ""
+	}
+
+	return cacheVal.FamilyID
+}
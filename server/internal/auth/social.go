@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"server/internal/env"
+	"server/internal/models"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	ErrUnknownProvider    = errors.New("unknown provider")
+	ErrIdentityEmailTaken = errors.New("email already registered, log in and link the provider instead")
+	ErrIdentityLinked     = errors.New("identity already linked to an account")
+	ErrIdentityUnverified = errors.New("provider has not verified the email")
+)
+
+// oauthState is kept at oauth_state:<state> between the redirect to the
+// provider and its callback. The state is bound to the browser that started
+// the flow by a random value kept in a cookie, so a callback URL cannot be
+// replayed in someone else's browser to log them into another account.
+type oauthState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	BindingHash  string
+	// LinkUserID is set when an existing account links the provider instead
+	// of logging in with it.
+	LinkUserID int
+}
+
+// StartOAuth returns the provider URL to send the user to, and the binding
+// the browser has to present on the callback. linkUID is the account to link
+// the identity to, or 0 to log in with it.
+func (s *Service) StartOAuth(providerName string, linkUID int) (string, string, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	stateBytes, err := json.Marshal(oauthState{
+		Provider:     providerName,
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		BindingHash:  hashOpaqueToken(binding),
+		LinkUserID:   linkUID,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("json marshal: %w", err)
+	}
+
+	if err := s.rdb.Set(context.Background(), "oauth_state:"+state, stateBytes, oauthStateTTL).Err(); err != nil {
+		return "", "", fmt.Errorf("redis set: %w", err)
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	authURL, err := provider.AuthCodeURL(context.Background(), state, base64.RawURLEncoding.EncodeToString(challenge[:]), nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("auth code url: %w", err)
+	}
+
+	return authURL, binding, nil
+}
+
+// FinishOAuth handles the provider callback, given the binding from the
+// browser's cookie. For a login it returns the result of the usual token
+// path, for a link it returns the linked account.
+func (s *Service) FinishOAuth(providerName string, state string, code string, binding string, client models.ClientInfo) (*models.LoginResult, int, error) {
+	stateJson, err := s.rdb.GetDel(context.Background(), "oauth_state:"+state).Result()
+	if err == redis.Nil {
+		return nil, 0, fmt.Errorf("oauth state invalid or expired")
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("redis getdel: %w", err)
+	}
+
+	st := oauthState{}
+	if err := json.Unmarshal([]byte(stateJson), &st); err != nil {
+		return nil, 0, fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	if st.Provider != providerName {
+		return nil, 0, fmt.Errorf("oauth state provider mismatch")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashOpaqueToken(binding)), []byte(st.BindingHash)) != 1 {
+		return nil, 0, fmt.Errorf("oauth state not started by this browser")
+	}
+
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, 0, ErrUnknownProvider
+	}
+
+	identity, err := provider.Exchange(context.Background(), code, st.CodeVerifier, st.Nonce)
+	if err != nil {
+		return nil, 0, fmt.Errorf("exchange: %w", err)
+	}
+
+	if st.LinkUserID != 0 {
+		if err := s.linkIdentity(st.LinkUserID, identity); err != nil {
+			return nil, 0, err
+		}
+		return nil, st.LinkUserID, nil
+	}
+
+	uid, err := s.resolveIdentity(identity)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var totpEnabled, emailVerified bool
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT totp_enabled_at IS NOT NULL, email_verified_at IS NOT NULL FROM accounts WHERE id = $1",
+		uid,
+	).Scan(&totpEnabled, &emailVerified); err != nil {
+		return nil, 0, fmt.Errorf("postgres select: %w", err)
+	}
+
+	if env.C.EmailVerificationPolicy == env.EmailVerificationLogin && !emailVerified {
+		return nil, 0, ErrEmailNotVerified
+	}
+
+	if totpEnabled {
+		res, err := s.startMFA(uid)
+		return res, 0, err
+	}
+
+	res, err := s.startSession(uid, providerName, client)
+	return res, 0, err
+}
+
+// resolveIdentity finds the account linked to the identity, creating one on
+// first sign in. Accounts are only created for emails the provider verified.
+// An existing account with the same email is never linked automatically, its
+// owner has to log in and link the provider themselves.
+func (s *Service) resolveIdentity(identity *ExternalIdentity) (int, error) {
+	var uid int
+	err := s.db.QueryRow(context.Background(),
+		"SELECT account_id FROM account_identities WHERE provider = $1 AND subject = $2",
+		identity.Provider, identity.Subject,
+	).Scan(&uid)
+	if err == nil {
+		return uid, nil
+	} else if err != pgx.ErrNoRows {
+		return 0, fmt.Errorf("postgres select: %w", err)
+	}
+
+	if identity.Email == "" {
+		return 0, fmt.Errorf("provider returned no email")
+	}
+	if !identity.EmailVerified {
+		return 0, ErrIdentityUnverified
+	}
+
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("postgres begin: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := tx.QueryRow(context.Background(),
+		"INSERT INTO accounts (email, email_verified_at) VALUES ($1, NOW()) RETURNING id",
+		identity.Email,
+	).Scan(&uid); err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
+			return 0, ErrIdentityEmailTaken
+		}
+		return 0, fmt.Errorf("postgres insert: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(),
+		"INSERT INTO account_identities (account_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		uid, identity.Provider, identity.Subject, identity.Email,
+	); err != nil {
+		return 0, fmt.Errorf("postgres insert: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(),
+		"INSERT INTO player_profiles (account_id) VALUES ($1)",
+		uid,
+	); err != nil {
+		return 0, fmt.Errorf("postgres insert: %w", err)
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return 0, fmt.Errorf("postgres commit: %w", err)
+	}
+
+	return uid, nil
+}
+
+func (s *Service) linkIdentity(uid int, identity *ExternalIdentity) error {
+	if _, err := s.db.Exec(context.Background(),
+		"INSERT INTO account_identities (account_id, provider, subject, email) VALUES ($1, $2, $3, NULLIF($4, ''))",
+		uid, identity.Provider, identity.Subject, identity.Email,
+	); err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrIdentityLinked
+		}
+		return fmt.Errorf("postgres insert: %w", err)
+	}
+
+	return nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand read: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"server/internal/env"
+	"server/internal/throttle"
+	"time"
+)
+
+// Failed logins are counted in sliding windows per email and per IP, kept as
+// sorted sets of failure timestamps at login_fail:<scope>:<id>. Past
+// LoginDelayAfterFailures failures an email has to wait an exponentially
+// growing delay between attempts (login_delay:email:<email>), and past the
+// max failures the email or IP is locked out (login_lock:<scope>:<id>).
+
+// ThrottledError is returned by Login when the attempt was refused without
+// checking the password.
+type ThrottledError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("login locked, retry after %s", e.RetryAfter)
+	}
+	return fmt.Sprintf("login throttled, retry after %s", e.RetryAfter)
+}
+
+func (s *Service) checkLoginThrottle(email string, ip string) error {
+	pipe := s.rdb.Pipeline()
+	emailLock := pipe.PTTL(context.Background(), "login_lock:email:"+email)
+	ipLock := pipe.PTTL(context.Background(), "login_lock:ip:"+ip)
+	emailDelay := pipe.PTTL(context.Background(), "login_delay:email:"+email)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("redis pipeline: %w", err)
+	}
+
+	if ttl := max(emailLock.Val(), ipLock.Val()); ttl > 0 {
+		return &ThrottledError{Locked: true, RetryAfter: ttl}
+	}
+
+	if ttl := emailDelay.Val(); ttl > 0 {
+		return &ThrottledError{RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+func (s *Service) recordLoginFailure(email string, ip string) error {
+	window := time.Duration(env.C.LoginFailureWindowSeconds) * time.Second
+
+	emailFailures, err := throttle.RecordFailure(s.rdb, "login_fail:email:"+email, window)
+	if err != nil {
+		return err
+	}
+
+	ipFailures, err := throttle.RecordFailure(s.rdb, "login_fail:ip:"+ip, window)
+	if err != nil {
+		return err
+	}
+
+	lockout := time.Duration(env.C.LoginLockoutSeconds) * time.Second
+
+	pipe := s.rdb.Pipeline()
+	if emailFailures >= env.C.LoginMaxFailuresPerEmail {
+		pipe.Set(context.Background(), "login_lock:email:"+email, 1, lockout)
+	} else if emailFailures >= env.C.LoginDelayAfterFailures {
+		pipe.Set(context.Background(), "login_delay:email:"+email, 1, loginDelay(emailFailures))
+	}
+	if ipFailures >= env.C.LoginMaxFailuresPerIP {
+		pipe.Set(context.Background(), "login_lock:ip:"+ip, 1, lockout)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("redis pipeline: %w", err)
+	}
+
+	return nil
+}
+
+// clearLoginFailures resets the email's counters after a successful login.
+// The IP counters are kept, one good account does not vouch for the others
+// tried from the same address.
+func (s *Service) clearLoginFailures(email string) error {
+	if err := s.rdb.Del(context.Background(),
+		"login_fail:email:"+email,
+		"login_delay:email:"+email,
+	).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	return nil
+}
+
+// loginDelay doubles from LoginDelayBaseSeconds for every failure past
+// LoginDelayAfterFailures, capped at LoginDelayMaxSeconds.
+func loginDelay(failures int) time.Duration {
+	exp := failures - env.C.LoginDelayAfterFailures
+	delay := float64(env.C.LoginDelayBaseSeconds) * math.Pow(2, float64(exp))
+
+	return time.Duration(min(delay, float64(env.C.LoginDelayMaxSeconds))) * time.Second
+}
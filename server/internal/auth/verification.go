@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"server/internal/env"
+	"server/internal/mailer"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Service) sendVerificationEmail(uid int, email string) error {
+	ttl := time.Duration(env.C.EmailVerificationTokenSeconds) * time.Second
+
+	token, err := s.issueOpaqueToken("email_verify", uid, ttl)
+	if err != nil {
+		return fmt.Errorf("issue token: %w", err)
+	}
+
+	if err := s.mailer.Send(mailer.Mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Use the following code to verify your email address:\n\n%s\n\nThe code expires in %s.",
+			token, ttl),
+	}); err != nil {
+		return fmt.Errorf("mailer send: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyEmail consumes a verification token and marks the account's email as
+// verified. The email_verified claim is updated on the next token refresh.
+func (s *Service) VerifyEmail(token string) error {
+	uid, err := s.consumeOpaqueToken("email_verify", token)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET email_verified_at = NOW() WHERE id = $1 AND email_verified_at IS NULL",
+		uid); err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+
+	return nil
+}
+
+// ResendVerificationEmail sends a fresh verification mail. It does not report
+// whether the address exists, is already verified or is in cooldown, so it
+// cannot be used to probe for accounts.
+func (s *Service) ResendVerificationEmail(email string) error {
+	email = strings.ToLower(email)
+
+	var uid int
+	var verified bool
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT id, email_verified_at IS NOT NULL FROM accounts WHERE email = $1",
+		email,
+	).Scan(&uid, &verified); err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	if verified {
+		return nil
+	}
+
+	ok, err := s.rdb.SetNX(context.Background(),
+		fmt.Sprintf("email_verify_resend:%d", uid), 1,
+		time.Duration(env.C.EmailVerificationResendSeconds)*time.Second,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("redis setnx: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	return s.sendVerificationEmail(uid, email)
+}
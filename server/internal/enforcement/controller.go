@@ -0,0 +1,155 @@
+package enforcement
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server/internal/middlewares"
+	"server/internal/models"
+	"server/pkg/betools"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Controller struct {
+	svc *Service
+}
+
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
+}
+
+func (c *Controller) GetRoutes() []betools.Route {
+	return betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+			middlewares.RequireRole(models.RoleAdmin, models.RoleModerator),
+		},
+		[]betools.Route{
+			{
+				Method:      "GET",
+				Pattern:     "/admin/players/{uid}/sanctions",
+				HandlerFunc: c.handleList,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/admin/players/{uid}/sanctions",
+				HandlerFunc: c.handleIssue,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.IssueSanctionRequest](),
+				},
+			},
+			{
+				Method:      "PUT",
+				Pattern:     "/admin/players/{uid}/sanctions/{id}/appeal",
+				HandlerFunc: c.handleSetAppealNote,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.UpdateAppealNoteRequest](),
+				},
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/admin/players/{uid}/sanctions/{id}",
+				HandlerFunc: c.handleLift,
+			},
+		},
+	)
+}
+
+func (c *Controller) handleList(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(chi.URLParam(r, "uid"))
+	if err != nil {
+		slog.Error("list sanctions", "uid", chi.URLParam(r, "uid"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list sanctions")
+		return
+	}
+
+	res, err := c.svc.List(uid)
+	if err != nil {
+		slog.Error("list sanctions", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list sanctions")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleIssue(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.IssueSanctionRequest](r)
+	moderator := betools.GetAuthCtx(r).UserID
+
+	uid, err := strconv.Atoi(chi.URLParam(r, "uid"))
+	if err != nil {
+		slog.Error("issue sanction", "uid", chi.URLParam(r, "uid"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to issue sanction")
+		return
+	}
+
+	res, err := c.svc.Issue(uid, moderator, req)
+	if errors.Is(err, ErrInvalidSchedule) {
+		slog.Error("issue sanction", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		slog.Error("issue sanction", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to issue sanction")
+		return
+	}
+
+	slog.Info("sanction issued", "uid", uid, "moderator", moderator, "sanction_id", res.ID, "kind", res.Kind, "ends_at", res.EndsAt)
+
+	betools.SendCreatedResponse(w, res)
+}
+
+func (c *Controller) handleSetAppealNote(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.UpdateAppealNoteRequest](r)
+
+	uid, errUID := strconv.Atoi(chi.URLParam(r, "uid"))
+	id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+	if err := errors.Join(errUID, errID); err != nil {
+		slog.Error("set appeal note", "uid", chi.URLParam(r, "uid"), "id", chi.URLParam(r, "id"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to set appeal note")
+		return
+	}
+
+	if err := c.svc.SetAppealNote(uid, id, req.AppealNote); errors.Is(err, ErrNotFound) {
+		slog.Error("set appeal note", "uid", uid, "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "sanction not found")
+		return
+	} else if err != nil {
+		slog.Error("set appeal note", "uid", uid, "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to set appeal note")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleLift(w http.ResponseWriter, r *http.Request) {
+	moderator := betools.GetAuthCtx(r).UserID
+
+	uid, errUID := strconv.Atoi(chi.URLParam(r, "uid"))
+	id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+	if err := errors.Join(errUID, errID); err != nil {
+		slog.Error("lift sanction", "uid", chi.URLParam(r, "uid"), "id", chi.URLParam(r, "id"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to lift sanction")
+		return
+	}
+
+	if err := c.svc.Lift(uid, id, moderator); errors.Is(err, ErrNotFound) {
+		slog.Error("lift sanction", "uid", uid, "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "sanction not found")
+		return
+	} else if err != nil {
+		slog.Error("lift sanction", "uid", uid, "id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to lift sanction")
+		return
+	}
+
+	slog.Info("sanction lifted", "uid", uid, "moderator", moderator, "sanction_id", id)
+
+	betools.SendOKResponse(w)
+}
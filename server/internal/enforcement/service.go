@@ -0,0 +1,194 @@
+package enforcement
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"server/internal/env"
+	"server/internal/models"
+	"time"
+
+	"github.com/georgysavva/scany/v2/pgxscan"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrNotFound        = errors.New("sanction not found")
+	ErrInvalidSchedule = errors.New("sanction must end after it starts, and suspensions must end")
+)
+
+const sanctionColumns = "id, account_id, kind, reason, issued_by, starts_at, ends_at, appeal_note, lifted_at, lifted_by, created_at"
+
+type Service struct {
+	rdb *redis.Client
+	db  *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool, rdb *redis.Client) *Service {
+	return &Service{
+		rdb: rdb,
+		db:  db,
+	}
+}
+
+func (s *Service) Issue(uid int, issuedBy int, req models.IssueSanctionRequest) (*models.Sanction, error) {
+	startsAt := time.Now()
+	if req.StartsAt != nil {
+		startsAt = *req.StartsAt
+	}
+
+	if req.Kind == models.SanctionSuspension && req.EndsAt == nil {
+		return nil, ErrInvalidSchedule
+	}
+	if req.EndsAt != nil && (!req.EndsAt.After(startsAt) || !req.EndsAt.After(time.Now())) {
+		return nil, ErrInvalidSchedule
+	}
+
+	sanction := models.Sanction{}
+	if err := pgxscan.Get(context.Background(), s.db, &sanction,
+		"INSERT INTO sanctions (account_id, kind, reason, issued_by, starts_at, ends_at, appeal_note) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING "+sanctionColumns,
+		uid, req.Kind, req.Reason, issuedBy, startsAt, req.EndsAt, req.AppealNote,
+	); err != nil {
+		return nil, fmt.Errorf("postgres insert: %w", err)
+	}
+
+	if err := s.invalidate(uid); err != nil {
+		return nil, err
+	}
+
+	return &sanction, nil
+}
+
+// List returns the player's whole sanction history, newest first.
+func (s *Service) List(uid int) ([]models.Sanction, error) {
+	sanctions := []models.Sanction{}
+	if err := pgxscan.Select(context.Background(), s.db, &sanctions,
+		"SELECT "+sanctionColumns+" FROM sanctions WHERE account_id = $1 ORDER BY created_at DESC",
+		uid,
+	); err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	return sanctions, nil
+}
+
+// Lift ends the sanction early. It stays in the history with who lifted it.
+func (s *Service) Lift(uid int, id int, liftedBy int) error {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE sanctions SET lifted_at = NOW(), lifted_by = $1 WHERE id = $2 AND account_id = $3 AND lifted_at IS NULL",
+		liftedBy, id, uid)
+	if err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return s.invalidate(uid)
+}
+
+func (s *Service) SetAppealNote(uid int, id int, note string) error {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE sanctions SET appeal_note = $1 WHERE id = $2 AND account_id = $3",
+		note, id, uid)
+	if err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return s.invalidate(uid)
+}
+
+// CheckBan returns a *models.BannedError when a ban or suspension is in force
+// for the player. It implements middlewares.BanChecker and is on the path of
+// every authenticated request, so it only reads the cache after the first
+// call.
+func (s *Service) CheckBan(uid int) error {
+	sanctions, err := s.pending(uid)
+	if err != nil {
+		return err
+	}
+
+	var ban *models.Sanction
+	now := time.Now()
+	for i, sanction := range sanctions {
+		if sanction.Kind != models.SanctionBan && sanction.Kind != models.SanctionSuspension {
+			continue
+		}
+		if !sanction.ActiveAt(now) {
+			continue
+		}
+		// report the one keeping the player out the longest
+		if ban == nil || sanction.EndsAt == nil || (ban.EndsAt != nil && sanction.EndsAt.After(*ban.EndsAt)) {
+			ban = &sanctions[i]
+		}
+	}
+
+	if ban != nil {
+		return &models.BannedError{Sanction: *ban}
+	}
+
+	return nil
+}
+
+// Active returns the sanction of the given kind in force for the player, or
+// nil. Features gated by ranked bans and mutes check it.
+func (s *Service) Active(uid int, kind string) (*models.Sanction, error) {
+	sanctions, err := s.pending(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i, sanction := range sanctions {
+		if sanction.Kind == kind && sanction.ActiveAt(now) {
+			return &sanctions[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// pending returns the sanctions not lifted nor over yet, including those
+// starting later, cached at sanctions:<uid>. Expiry is checked by the callers
+// on each read, so the cache only has to be dropped when a sanction changes.
+func (s *Service) pending(uid int) ([]models.Sanction, error) {
+	sanctions := []models.Sanction{}
+
+	sanctionsJson, err := s.rdb.Get(context.Background(), fmt.Sprintf("sanctions:%d", uid)).Result()
+	if err == redis.Nil {
+		if err := pgxscan.Select(context.Background(), s.db, &sanctions,
+			"SELECT "+sanctionColumns+" FROM sanctions WHERE account_id = $1 AND lifted_at IS NULL AND (ends_at IS NULL OR ends_at > NOW())",
+			uid,
+		); err != nil {
+			return nil, fmt.Errorf("postgres select: %w", err)
+		}
+		sanctionsJsonFromDB, err := json.Marshal(sanctions)
+		if err != nil {
+			return nil, fmt.Errorf("json marshal: %w", err)
+		}
+		if err := s.rdb.Set(context.Background(), fmt.Sprintf("sanctions:%d", uid), string(sanctionsJsonFromDB), time.Duration(env.C.SanctionCacheSeconds)*time.Second).Err(); err != nil {
+			return nil, fmt.Errorf("redis set: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	} else {
+		if err := json.Unmarshal([]byte(sanctionsJson), &sanctions); err != nil {
+			return nil, fmt.Errorf("json unmarshal: %w", err)
+		}
+	}
+
+	return sanctions, nil
+}
+
+func (s *Service) invalidate(uid int) error {
+	if err := s.rdb.Del(context.Background(), fmt.Sprintf("sanctions:%d", uid)).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	return nil
+}
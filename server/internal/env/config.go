@@ -1,6 +1,10 @@
 package env
 
-import "github.com/caarlos0/env/v10"
+import (
+	"fmt"
+
+	"github.com/caarlos0/env/v10"
+)
 
 type Env struct {
 	IsProd bool `env:"IS_PROD" envDefault:"false"`
@@ -21,9 +25,84 @@ type Env struct {
 
 	AccountInfoCacheSeconds int `env:"ACCOUNT_INFO_CACHE_SECONDS" envDefault:"60"`
 
-	JWTSecret string `env:"JWT_SECRET"`
+	TokenRevocationCacheSeconds int `env:"TOKEN_REVOCATION_CACHE_SECONDS" envDefault:"5"`
+	// StreamAuthRecheckSeconds is how often SSE streams check their token
+	// was not revoked nor the player banned since they connected.
+	StreamAuthRecheckSeconds int `env:"STREAM_AUTH_RECHECK_SECONDS" envDefault:"30"`
+
+	JWTKeysDir      string `env:"JWT_KEYS_DIR" envDefault:"keys"`
+	JWTSigningKeyID string `env:"JWT_SIGNING_KEY_ID" envDefault:""`
+
+	MailerDriver   string `env:"MAILER_DRIVER" envDefault:"smtp"` // smtp, or log or file outside production
+	MailerFrom     string `env:"MAILER_FROM" envDefault:"no-reply@localhost"`
+	MailerFileDir  string `env:"MAILER_FILE_DIR" envDefault:"mails"`
+	MailerSMTPHost string `env:"MAILER_SMTP_HOST" envDefault:""`
+	MailerSMTPPort string `env:"MAILER_SMTP_PORT" envDefault:"587"`
+	MailerSMTPUser string `env:"MAILER_SMTP_USER" envDefault:""`
+	MailerSMTPPass string `env:"MAILER_SMTP_PASS" envDefault:""`
+
+	EmailVerificationPolicy        string `env:"EMAIL_VERIFICATION_POLICY" envDefault:"none"` // none, login or ranked
+	EmailVerificationTokenSeconds  int    `env:"EMAIL_VERIFICATION_TOKEN_SECONDS" envDefault:"86400"`
+	EmailVerificationResendSeconds int    `env:"EMAIL_VERIFICATION_RESEND_SECONDS" envDefault:"60"`
+
+	PasswordResetTokenSeconds  int `env:"PASSWORD_RESET_TOKEN_SECONDS" envDefault:"3600"`
+	PasswordResetResendSeconds int `env:"PASSWORD_RESET_RESEND_SECONDS" envDefault:"60"`
+
+	LoginFailureWindowSeconds int `env:"LOGIN_FAILURE_WINDOW_SECONDS" envDefault:"900"`
+	LoginMaxFailuresPerEmail  int `env:"LOGIN_MAX_FAILURES_PER_EMAIL" envDefault:"10"`
+	LoginMaxFailuresPerIP     int `env:"LOGIN_MAX_FAILURES_PER_IP" envDefault:"50"`
+	LoginLockoutSeconds       int `env:"LOGIN_LOCKOUT_SECONDS" envDefault:"900"`
+	LoginDelayAfterFailures   int `env:"LOGIN_DELAY_AFTER_FAILURES" envDefault:"3"`
+	LoginDelayBaseSeconds     int `env:"LOGIN_DELAY_BASE_SECONDS" envDefault:"1"`
+	LoginDelayMaxSeconds      int `env:"LOGIN_DELAY_MAX_SECONDS" envDefault:"30"`
+
+	MFAFailureWindowSeconds int `env:"MFA_FAILURE_WINDOW_SECONDS" envDefault:"900"`
+	MFAMaxFailures          int `env:"MFA_MAX_FAILURES" envDefault:"5"`
+	MFALockoutSeconds       int `env:"MFA_LOCKOUT_SECONDS" envDefault:"900"`
+
+	// StepUpMaxAgeSeconds is how recent the login of an account without a
+	// password or 2FA must be to confirm a sensitive action.
+	StepUpMaxAgeSeconds int `env:"STEP_UP_MAX_AGE_SECONDS" envDefault:"300"`
+
+	GuestMaxCreatesPerIPPerHour int `env:"GUEST_MAX_CREATES_PER_IP_PER_HOUR" envDefault:"20"`
+
+	OIDCProvidersFile string `env:"OIDC_PROVIDERS_FILE" envDefault:"oidc_providers.json"`
+
+	APIKeyCacheSeconds   int `env:"API_KEY_CACHE_SECONDS" envDefault:"60"`
+	SanctionCacheSeconds int `env:"SANCTION_CACHE_SECONDS" envDefault:"300"`
+
+	PresenceTTLSeconds   int `env:"PRESENCE_TTL_SECONDS" envDefault:"60"`
+	PresenceSweepSeconds int `env:"PRESENCE_SWEEP_SECONDS" envDefault:"15"`
+
+	ProfileCacheSeconds         int `env:"PROFILE_CACHE_SECONDS" envDefault:"300"`
+	HandleChangeCooldownSeconds int `env:"HANDLE_CHANGE_COOLDOWN_SECONDS" envDefault:"2592000"` // 30 days
+
+	DataExportTTLSeconds        int `env:"DATA_EXPORT_TTL_SECONDS" envDefault:"86400"`
+	DataExportCooldownSeconds   int `env:"DATA_EXPORT_COOLDOWN_SECONDS" envDefault:"3600"`
+	AccountDeletionGraceSeconds int `env:"ACCOUNT_DELETION_GRACE_SECONDS" envDefault:"2592000"` // 30 days
+	AccountPurgeIntervalSeconds int `env:"ACCOUNT_PURGE_INTERVAL_SECONDS" envDefault:"3600"`
+
+	StorageMaxValueBytes int `env:"STORAGE_MAX_VALUE_BYTES" envDefault:"65536"`
+	StorageMaxKeys       int `env:"STORAGE_MAX_KEYS" envDefault:"100"`
+	StorageCacheSeconds  int `env:"STORAGE_CACHE_SECONDS" envDefault:"300"`
+
+	LobbyMinPlayers           int `env:"LOBBY_MIN_PLAYERS" envDefault:"2"`
+	LobbyReadyCheckSeconds    int `env:"LOBBY_READY_CHECK_SECONDS" envDefault:"30"`
+	LobbyCountdownSeconds     int `env:"LOBBY_COUNTDOWN_SECONDS" envDefault:"10"`
+	LobbyLaunchTimeoutSeconds int `env:"LOBBY_LAUNCH_TIMEOUT_SECONDS" envDefault:"60"`
+	LobbySchedulerTickMillis  int `env:"LOBBY_SCHEDULER_TICK_MILLIS" envDefault:"250"`
+
+	LobbyJoinFailureWindowSeconds int `env:"LOBBY_JOIN_FAILURE_WINDOW_SECONDS" envDefault:"600"`
+	LobbyJoinMaxFailures          int `env:"LOBBY_JOIN_MAX_FAILURES" envDefault:"10"`
+	LobbyJoinLockoutSeconds       int `env:"LOBBY_JOIN_LOCKOUT_SECONDS" envDefault:"600"`
 }
 
+const (
+	EmailVerificationNone   = "none"
+	EmailVerificationLogin  = "login"
+	EmailVerificationRanked = "ranked"
+)
+
 var C *Env
 
 func Load() error {
@@ -34,6 +113,12 @@ func Load() error {
 		return err
 	}
 
+	switch c.EmailVerificationPolicy {
+	case EmailVerificationNone, EmailVerificationLogin, EmailVerificationRanked:
+	default:
+		return fmt.Errorf("invalid EMAIL_VERIFICATION_POLICY %q", c.EmailVerificationPolicy)
+	}
+
 	C = &c
 
 	return nil
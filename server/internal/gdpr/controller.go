@@ -0,0 +1,185 @@
+package gdpr
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"server/internal/auth"
+	"server/internal/middlewares"
+	"server/internal/models"
+	"server/pkg/betools"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Controller struct {
+	svc *Service
+}
+
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
+}
+
+func (c *Controller) GetRoutes() []betools.Route {
+	return betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "POST",
+				Pattern:     "/player/me/export",
+				HandlerFunc: c.handleRequestExport,
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/player/me/export/{id}",
+				HandlerFunc: c.handleGetExport,
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/player/me/export/{id}/download",
+				HandlerFunc: c.handleDownloadExport,
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/player/me",
+				HandlerFunc: c.handleScheduleDeletion,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.DeleteAccountRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/player/me/deletion/cancel",
+				HandlerFunc: c.handleCancelDeletion,
+			},
+		},
+	)
+}
+
+func (c *Controller) handleRequestExport(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.RequestExport(uid)
+	var cooldown *ExportCooldownError
+	if errors.As(err, &cooldown) {
+		slog.Error("request data export", "uid", uid, "error", err)
+		retryAfter := int(math.Ceil(cooldown.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		betools.SendErrorCodeResponse(w, http.StatusTooManyRequests, "export_cooldown", "export requested too recently", map[string]int{
+			"retry_after_seconds": retryAfter,
+		})
+		return
+	} else if err != nil {
+		slog.Error("request data export", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to request data export")
+		return
+	}
+
+	slog.Info("data export requested", "uid", uid, "export_id", res.ID)
+
+	betools.SendSuccessResponse(w, http.StatusAccepted, res)
+}
+
+func (c *Controller) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "id")
+
+	res, err := c.svc.GetExport(uid, id)
+	if errors.Is(err, ErrExportNotFound) {
+		slog.Error("get data export", "uid", uid, "export_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "export not found")
+		return
+	} else if err != nil {
+		slog.Error("get data export", "uid", uid, "export_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get data export")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+// handleDownloadExport serves the archive itself rather than the response
+// envelope, as a file to save.
+func (c *Controller) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "id")
+
+	archive, err := c.svc.GetArchive(uid, id)
+	if errors.Is(err, ErrExportNotFound) {
+		slog.Error("download data export", "uid", uid, "export_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "export not found")
+		return
+	} else if errors.Is(err, ErrExportNotReady) {
+		slog.Error("download data export", "uid", uid, "export_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, "export not ready")
+		return
+	} else if err != nil {
+		slog.Error("download data export", "uid", uid, "export_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to download data export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="player-data-`+strconv.Itoa(uid)+`.json"`)
+	w.Write(archive)
+}
+
+func (c *Controller) handleScheduleDeletion(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.DeleteAccountRequest](r)
+	player := betools.GetAuthCtx(r)
+	uid := player.UserID
+
+	scheduledFor, err := c.svc.ScheduleDeletion(player, req, auth.ClientInfo(r))
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		auth.SendThrottled(w, throttled)
+		return
+	} else if errors.Is(err, auth.ErrWrongPassword) || errors.Is(err, auth.ErrInvalidMFACode) {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusForbidden, "wrong password or code")
+		return
+	} else if errors.Is(err, auth.ErrMFACodeRequired) {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		betools.SendErrorCodeResponse(w, http.StatusForbidden, "mfa_required", "2fa code required", nil)
+		return
+	} else if errors.Is(err, auth.ErrReauthRequired) {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		betools.SendErrorCodeResponse(w, http.StatusForbidden, "reauth_required", "log in again to confirm", nil)
+		return
+	} else if errors.Is(err, ErrDeletionAlreadyQueued) {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		slog.Error("schedule account deletion", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to delete account")
+		return
+	}
+
+	betools.SendSuccessResponse(w, http.StatusAccepted, models.AccountDeletionResponse{
+		ScheduledFor: scheduledFor,
+	})
+}
+
+func (c *Controller) handleCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	if err := c.svc.CancelDeletion(uid); errors.Is(err, ErrDeletionNotScheduled) {
+		slog.Error("cancel account deletion", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		slog.Error("cancel account deletion", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to cancel account deletion")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
@@ -0,0 +1,386 @@
+package gdpr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"server/internal/auth"
+	"server/internal/env"
+	"server/internal/models"
+	"server/internal/player"
+	"server/internal/presence"
+	"server/internal/storage"
+	"server/pkg/betools"
+	"time"
+
+	"github.com/georgysavva/scany/v2/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Exports are built in the background and kept in Valkey for
+// DataExportTTLSeconds: the status at data_export:<id> and the archive at
+// data_export_archive:<id>. A player can ask for one every
+// DataExportCooldownSeconds (data_export_cooldown:<uid>).
+//
+// Deleting an account only schedules it: tokens are revoked and caches
+// dropped right away, and the purger anonymizes the account once
+// AccountDeletionGraceSeconds have passed. Until then the player can log back
+// in and cancel. The account row itself is kept, scrubbed, so history
+// pointing at it stays consistent.
+
+var (
+	ErrExportNotFound        = errors.New("export not found")
+	ErrExportNotReady        = errors.New("export not ready")
+	ErrDeletionNotScheduled  = errors.New("account deletion not scheduled")
+	ErrDeletionAlreadyQueued = errors.New("account deletion already scheduled")
+)
+
+// ExportCooldownError is returned when the player asked for an export too
+// recently.
+type ExportCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ExportCooldownError) Error() string {
+	return fmt.Sprintf("export requested recently, retry after %s", e.RetryAfter)
+}
+
+type Service struct {
+	rdb      *redis.Client
+	db       *pgxpool.Pool
+	auth     *auth.Service
+	players  *player.Service
+	presence *presence.Service
+	storage  *storage.Service
+}
+
+func NewService(db *pgxpool.Pool, rdb *redis.Client, authService *auth.Service, playerService *player.Service, presenceService *presence.Service, storageService *storage.Service) *Service {
+	return &Service{
+		rdb:      rdb,
+		db:       db,
+		auth:     authService,
+		players:  playerService,
+		presence: presenceService,
+		storage:  storageService,
+	}
+}
+
+// RequestExport starts building the player's data archive and returns its
+// status to poll.
+func (s *Service) RequestExport(uid int) (*models.DataExport, error) {
+	cooldownKey := fmt.Sprintf("data_export_cooldown:%d", uid)
+	ok, err := s.rdb.SetNX(context.Background(), cooldownKey, 1, time.Duration(env.C.DataExportCooldownSeconds)*time.Second).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis setnx: %w", err)
+	}
+	if !ok {
+		ttl, err := s.rdb.PTTL(context.Background(), cooldownKey).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis pttl: %w", err)
+		}
+		return nil, &ExportCooldownError{RetryAfter: ttl}
+	}
+
+	now := time.Now()
+	export := models.DataExport{
+		ID:        uuid.NewString(),
+		UserID:    uid,
+		Status:    models.DataExportPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(env.C.DataExportTTLSeconds) * time.Second),
+	}
+	if err := s.saveExport(export); err != nil {
+		return nil, err
+	}
+
+	go s.buildExport(export)
+
+	return &export, nil
+}
+
+func (s *Service) buildExport(export models.DataExport) {
+	archive, err := s.collect(export.UserID)
+	if err == nil {
+		var archiveBytes []byte
+		if archiveBytes, err = json.MarshalIndent(archive, "", "  "); err == nil {
+			err = s.rdb.Set(context.Background(), "data_export_archive:"+export.ID, archiveBytes, time.Until(export.ExpiresAt)).Err()
+		}
+	}
+
+	export.Status = models.DataExportReady
+	if err != nil {
+		slog.Error("build data export", "uid", export.UserID, "export_id", export.ID, "error", err)
+		export.Status = models.DataExportFailed
+	}
+
+	if err := s.saveExport(export); err != nil {
+		slog.Error("build data export", "uid", export.UserID, "export_id", export.ID, "error", err)
+	}
+}
+
+func (s *Service) collect(uid int) (*models.DataExportArchive, error) {
+	archive := models.DataExportArchive{
+		GeneratedAt: time.Now(),
+		Identities:  []models.ExportedIdentity{},
+		Sanctions:   []models.Sanction{},
+	}
+
+	if err := pgxscan.Get(context.Background(), s.db, &archive.Account,
+		`SELECT id, first_name, last_name, email, email_verified_at, roles, is_guest, totp_enabled_at, created_at, deletion_scheduled_for
+		FROM accounts WHERE id = $1`,
+		uid); err != nil {
+		return nil, fmt.Errorf("postgres select account: %w", err)
+	}
+
+	profile := models.ExportedProfile{}
+	if err := pgxscan.Get(context.Background(), s.db, &profile,
+		`SELECT handle, display_name, avatar_url, level, rank, visibility, show_rank, handle_changed_at, updated_at
+		FROM player_profiles WHERE account_id = $1`,
+		uid); err == nil {
+		archive.Profile = &profile
+	} else if !pgxscan.NotFound(err) {
+		return nil, fmt.Errorf("postgres select profile: %w", err)
+	}
+
+	if err := pgxscan.Select(context.Background(), s.db, &archive.Identities,
+		"SELECT provider, subject, email, created_at FROM account_identities WHERE account_id = $1 ORDER BY created_at",
+		uid); err != nil {
+		return nil, fmt.Errorf("postgres select identities: %w", err)
+	}
+
+	if err := pgxscan.Select(context.Background(), s.db, &archive.Sanctions,
+		`SELECT id, account_id, kind, reason, issued_by, starts_at, ends_at, appeal_note, lifted_at, lifted_by, created_at
+		FROM sanctions WHERE account_id = $1 ORDER BY created_at`,
+		uid); err != nil {
+		return nil, fmt.Errorf("postgres select sanctions: %w", err)
+	}
+
+	sessions, err := s.auth.ListSessions(uid, "")
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	archive.Sessions = sessions
+
+	entries, settings, err := s.storage.Export(uid)
+	if err != nil {
+		return nil, fmt.Errorf("export storage: %w", err)
+	}
+	archive.Storage = entries
+	archive.Settings = settings
+
+	return &archive, nil
+}
+
+// GetExport returns the status of one of the player's exports.
+func (s *Service) GetExport(uid int, id string) (*models.DataExport, error) {
+	exportJson, err := s.rdb.Get(context.Background(), "data_export:"+id).Result()
+	if err == redis.Nil {
+		return nil, ErrExportNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	}
+
+	export := models.DataExport{}
+	if err := json.Unmarshal([]byte(exportJson), &export); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	if export.UserID != uid {
+		return nil, ErrExportNotFound
+	}
+
+	return &export, nil
+}
+
+// GetArchive returns the JSON archive of a ready export.
+func (s *Service) GetArchive(uid int, id string) ([]byte, error) {
+	export, err := s.GetExport(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	if export.Status != models.DataExportReady {
+		return nil, ErrExportNotReady
+	}
+
+	archive, err := s.rdb.Get(context.Background(), "data_export_archive:"+id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrExportNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	}
+
+	return archive, nil
+}
+
+func (s *Service) saveExport(export models.DataExport) error {
+	exportBytes, err := json.Marshal(export)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	if err := s.rdb.Set(context.Background(), "data_export:"+export.ID, exportBytes, time.Until(export.ExpiresAt)).Err(); err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+
+	return nil
+}
+
+// ScheduleDeletion queues the account for deletion after the grace period and
+// logs it out everywhere. The caller has to step up first, see auth.StepUp.
+func (s *Service) ScheduleDeletion(player betools.AuthInfo, req models.DeleteAccountRequest, client models.ClientInfo) (time.Time, error) {
+	uid := player.UserID
+	if err := s.auth.StepUp(uid, player.SessionID, req.Password, req.Code, client); err != nil {
+		return time.Time{}, err
+	}
+
+	var scheduledFor time.Time
+	err := s.db.QueryRow(context.Background(),
+		"UPDATE accounts SET deletion_scheduled_for = NOW() + make_interval(secs => $1) WHERE id = $2 AND deletion_scheduled_for IS NULL AND deleted_at IS NULL RETURNING deletion_scheduled_for",
+		float64(env.C.AccountDeletionGraceSeconds), uid,
+	).Scan(&scheduledFor)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, ErrDeletionAlreadyQueued
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("postgres update: %w", err)
+	}
+
+	if err := s.auth.RevokeAllTokens(uid); err != nil {
+		return time.Time{}, fmt.Errorf("revoke all tokens: %w", err)
+	}
+	if err := s.presence.SetOffline(uid); err != nil {
+		return time.Time{}, fmt.Errorf("set offline: %w", err)
+	}
+	if err := s.players.Forget(uid, ""); err != nil {
+		return time.Time{}, fmt.Errorf("forget player: %w", err)
+	}
+
+	slog.Info("account deletion scheduled", "uid", uid, "scheduled_for", scheduledFor)
+
+	return scheduledFor, nil
+}
+
+func (s *Service) CancelDeletion(uid int) error {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE accounts SET deletion_scheduled_for = NULL WHERE id = $1 AND deletion_scheduled_for IS NOT NULL AND deleted_at IS NULL",
+		uid)
+	if err != nil {
+		return fmt.Errorf("postgres update: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeletionNotScheduled
+	}
+
+	slog.Info("account deletion cancelled", "uid", uid)
+
+	return nil
+}
+
+// RunPurger anonymizes the accounts whose grace period is over.
+func (s *Service) RunPurger() {
+	ticker := time.NewTicker(time.Duration(env.C.AccountPurgeIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.purge(); err != nil {
+			slog.Error("account purge", "error", err)
+		}
+	}
+}
+
+func (s *Service) purge() error {
+	var uids []int
+	if err := pgxscan.Select(context.Background(), s.db, &uids,
+		"SELECT id FROM accounts WHERE deletion_scheduled_for <= NOW() AND deleted_at IS NULL",
+	); err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	// a failed account is tried again on the next run, the others go ahead
+	for _, uid := range uids {
+		if err := s.anonymize(uid); err != nil {
+			slog.Error("account purge", "uid", uid, "error", err)
+			continue
+		}
+		slog.Info("account deleted", "uid", uid)
+	}
+
+	return nil
+}
+
+// anonymize scrubs everything identifying from the account and drops what
+// only made sense while it was alive. Moderation history stays, attached to
+// an account nobody can be traced back to.
+//
+// Tokens and the handle index have no expiry, so they are cleaned up before
+// the account is marked deleted: if that fails nothing is committed and the
+// next purge starts over with everything still there to find. The caches
+// dropped after the commit expire on their own if that fails.
+func (s *Service) anonymize(uid int) error {
+	var handle string
+	if err := s.db.QueryRow(context.Background(),
+		"SELECT COALESCE(handle, '') FROM player_profiles WHERE account_id = $1",
+		uid,
+	).Scan(&handle); err != nil && err != pgx.ErrNoRows {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	if err := s.auth.RevokeAllTokens(uid); err != nil {
+		return fmt.Errorf("revoke all tokens: %w", err)
+	}
+	if err := s.players.Forget(uid, handle); err != nil {
+		return fmt.Errorf("forget player: %w", err)
+	}
+
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("postgres begin: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(),
+		`UPDATE accounts SET first_name = NULL, last_name = NULL, email = NULL, password_hash = NULL,
+			email_verified_at = NULL, totp_secret = NULL, totp_enabled_at = NULL, totp_recovery_codes = '{}',
+			device_id_hash = NULL, roles = '{}', deletion_scheduled_for = NULL, deleted_at = NOW()
+		WHERE id = $1`,
+		uid); err != nil {
+		return fmt.Errorf("postgres update accounts: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM account_identities WHERE account_id = $1", uid); err != nil {
+		return fmt.Errorf("postgres delete identities: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM player_profiles WHERE account_id = $1", uid); err != nil {
+		return fmt.Errorf("postgres delete profile: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(), "UPDATE sanctions SET appeal_note = '' WHERE account_id = $1", uid); err != nil {
+		return fmt.Errorf("postgres update sanctions: %w", err)
+	}
+
+	cacheKeys, err := s.storage.DeleteAll(tx, uid)
+	if err != nil {
+		return fmt.Errorf("delete storage: %w", err)
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return fmt.Errorf("postgres commit: %w", err)
+	}
+
+	// anything read back into the caches since Forget is dropped again
+	cacheKeys = append(cacheKeys,
+		fmt.Sprintf("sanctions:%d", uid),
+		fmt.Sprintf("account:%d", uid),
+		fmt.Sprintf("profile:%d", uid),
+	)
+	if err := s.rdb.Del(context.Background(), cacheKeys...).Err(); err != nil {
+		slog.Error("account purge drop caches", "uid", uid, "error", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+// Package jwtkeys holds the Ed25519 keys used to sign and verify our JWTs.
+//
+// Keys are read from PEM files in JWT_KEYS_DIR, the file name without
+// extension being the key ID ("kid"). A file holding a private key can sign
+// and verify, a file holding only a public key is kept for verification so
+// tokens signed by a retired key stay valid until they expire.
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"server/internal/env"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Key struct {
+	ID      string
+	Private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+type Keyset struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+var K *Keyset
+
+func Load() error {
+	ks, err := loadDir(env.C.JWTKeysDir)
+	if err != nil {
+		return err
+	}
+
+	if len(ks.keys) == 0 {
+		if env.C.IsProd {
+			return fmt.Errorf("no jwt keys found in %s", env.C.JWTKeysDir)
+		}
+
+		slog.Warn("no jwt keys found, generating an ephemeral signing key", "dir", env.C.JWTKeysDir)
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return fmt.Errorf("ed25519 generate: %w", err)
+		}
+		ks.keys["ephemeral"] = &Key{ID: "ephemeral", Private: priv, Public: pub}
+	}
+
+	if env.C.JWTSigningKeyID != "" {
+		ks.signing = ks.keys[env.C.JWTSigningKeyID]
+		if ks.signing == nil || ks.signing.Private == nil {
+			return fmt.Errorf("signing key %q not found or has no private key", env.C.JWTSigningKeyID)
+		}
+	} else {
+		// default to the newest private key, key IDs are expected to sort by
+		// creation date (e.g. 2025-01)
+		for _, kid := range ks.ids() {
+			if ks.keys[kid].Private != nil {
+				ks.signing = ks.keys[kid]
+			}
+		}
+		if ks.signing == nil {
+			return fmt.Errorf("no private key found in %s", env.C.JWTKeysDir)
+		}
+	}
+
+	slog.Info("jwt keys loaded", "keys", ks.ids(), "signing", ks.signing.ID)
+
+	K = ks
+
+	return nil
+}
+
+func loadDir(dir string) (*Keyset, error) {
+	ks := &Keyset{
+		keys: map[string]*Key{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("glob keys: %w", err)
+	}
+
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+
+		key, err := loadFile(kid, file)
+		if err != nil {
+			return nil, fmt.Errorf("load key %s: %w", file, err)
+		}
+
+		ks.keys[kid] = key
+	}
+
+	return ks, nil
+}
+
+func loadFile(kid string, file string) (*Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse pkcs8: %w", err)
+		}
+		priv, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 private key")
+		}
+		return &Key{ID: kid, Private: priv, Public: priv.Public().(ed25519.PublicKey)}, nil
+
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse pkix: %w", err)
+		}
+		pub, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 public key")
+		}
+		return &Key{ID: kid, Public: pub}, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected pem block %q", block.Type)
+	}
+}
+
+func (ks *Keyset) ids() []string {
+	ids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		ids = append(ids, kid)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Sign signs the claims with the current signing key and sets the kid header.
+func (ks *Keyset) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = ks.signing.ID
+
+	return token.SignedString(ks.signing.Private)
+}
+
+// Keyfunc selects the verification key by the token's kid header, for use
+// with jwt.Parse and jwt.ParseWithClaims.
+func (ks *Keyset) Keyfunc(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %q", kid)
+	}
+
+	return key.Public, nil
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every loaded key in RFC 8037 form.
+func (ks *Keyset) JWKS() JWKSet {
+	set := JWKSet{
+		Keys: []JWK{},
+	}
+	for _, kid := range ks.ids() {
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(ks.keys[kid].Public),
+			KeyID:     kid,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+	return set
+}
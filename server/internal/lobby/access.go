@@ -0,0 +1,140 @@
+package lobby
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"server/internal/env"
+	"server/internal/throttle"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Invite codes like K7Q-2PX skip characters easily mistaken for one another.
+const inviteAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+var (
+	ErrInviteRequired = errors.New("this lobby is joined with its invite code")
+	ErrWrongPassword  = errors.New("wrong lobby password")
+)
+
+// JoinThrottledError is returned after too many wrong codes or passwords.
+type JoinThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *JoinThrottledError) Error() string {
+	return fmt.Sprintf("too many failed joins, retry after %s", e.RetryAfter)
+}
+
+func newInviteCode() (string, error) {
+	code := make([]byte, 6)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("rand int: %w", err)
+		}
+		code[i] = inviteAlphabet[n.Int64()]
+	}
+
+	return string(code[:3]) + "-" + string(code[3:]), nil
+}
+
+func normalizeInviteCode(code string) (string, bool) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 6 {
+		return "", false
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(inviteAlphabet, c) {
+			return "", false
+		}
+	}
+
+	return code[:3] + "-" + code[3:], true
+}
+
+// resolve returns the lobby ID and whether an invite code was given.
+func (s *Service) resolve(uid int, ref string) (string, bool, error) {
+	if _, err := uuid.Parse(ref); err == nil {
+		return ref, false, nil
+	}
+
+	if err := s.checkJoinThrottle(uid); err != nil {
+		return "", true, err
+	}
+
+	code, ok := normalizeInviteCode(ref)
+	if !ok {
+		return "", true, s.joinFailed(uid, ErrNotFound)
+	}
+
+	id, err := s.rdb.Get(context.Background(), codeKey(code)).Result()
+	if err == redis.Nil {
+		return "", true, s.joinFailed(uid, ErrNotFound)
+	} else if err != nil {
+		return "", true, fmt.Errorf("redis get: %w", err)
+	}
+
+	return id, true, nil
+}
+
+func (s *Service) checkPassword(uid int, id string, password string) error {
+	if err := s.checkJoinThrottle(uid); err != nil {
+		return err
+	}
+
+	passHash, err := s.rdb.HGet(context.Background(), lobbyKey(id), "password_hash").Result()
+	if err == redis.Nil {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("redis hget: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passHash), []byte(password)); err != nil {
+		return s.joinFailed(uid, ErrWrongPassword)
+	}
+
+	return nil
+}
+
+func (s *Service) checkJoinThrottle(uid int) error {
+	ttl, err := s.rdb.PTTL(context.Background(), fmt.Sprintf("lobby_join_lock:%d", uid)).Result()
+	if err != nil {
+		return fmt.Errorf("redis pttl: %w", err)
+	}
+	if ttl > 0 {
+		return &JoinThrottledError{RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+// joinFailed records a failed code or password and returns reason.
+func (s *Service) joinFailed(uid int, reason error) error {
+	window := time.Duration(env.C.LobbyJoinFailureWindowSeconds) * time.Second
+
+	failures, err := throttle.RecordFailure(s.rdb, fmt.Sprintf("lobby_join_fail:%d", uid), window)
+	if err != nil {
+		return err
+	}
+
+	if failures >= env.C.LobbyJoinMaxFailures {
+		if err := s.rdb.Set(context.Background(), fmt.Sprintf("lobby_join_lock:%d", uid), 1,
+			time.Duration(env.C.LobbyJoinLockoutSeconds)*time.Second).Err(); err != nil {
+			return fmt.Errorf("redis set: %w", err)
+		}
+	}
+
+	return reason
+}
+
+func codeKey(code string) string {
+	return "lobby_code:" + code
+}
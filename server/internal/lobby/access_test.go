@@ -0,0 +1,40 @@
+package lobby
+
+import "testing"
+
+func TestNormalizeInviteCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+		ok   bool
+	}{
+		{"ABC-234", "ABC-234", true},
+		{"abc234", "ABC-234", true},
+		{" abc 234 ", "ABC-234", true},
+		{"a-b-c-2-3-4", "ABC-234", true},
+		{"ABC-23", "", false},
+		{"ABC-2345", "", false},
+		{"ABC-10O", "", false}, // 0, 1 and O are left out of the alphabet
+		{"ABC-23I", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizeInviteCode(tt.code)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeInviteCode(%q) = %q, %v, want %q, %v", tt.code, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewInviteCode(t *testing.T) {
+	for range 100 {
+		code, err := newInviteCode()
+		if err != nil {
+			t.Fatalf("new invite code: %v", err)
+		}
+		if got, ok := normalizeInviteCode(code); !ok || got != code {
+			t.Fatalf("generated code %q does not normalize to itself", code)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package lobby
+
+import (
+	"context"
+	"fmt"
+	"server/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Listed lobbies are kept in sorted sets by creation time, lobby_index:all and
+// one per setting, and in lobby_index:slots by open slots.
+const (
+	indexSlotsKey = "lobby_index:slots"
+	indexAllKey   = "lobby_index:all"
+)
+
+const listScriptChunk = 200
+
+// listScript returns the total followed by the IDs of the page ARGV[3]
+// (offset) and ARGV[4] (limit) of the lobbies in every filter set KEYS[4..]
+// with at least ARGV[1] open slots, sorted by ARGV[2]. KEYS[1] is a scratch
+// key, KEYS[2] the open slots and KEYS[3] the set of every listed lobby.
+var listScript = redis.NewScript(`
+local min_slots = tonumber(ARGV[1])
+local by_slots = ARGV[2] == "fullest" or ARGV[2] == "emptiest"
+local desc = ARGV[2] == "newest" or ARGV[2] == "emptiest"
+local start = tonumber(ARGV[3])
+local limit = tonumber(ARGV[4])
+local chunk = tonumber(ARGV[5])
+local filters = {}
+for i = 4, #KEYS do
+	filters[#filters + 1] = KEYS[i]
+end
+
+local function range(key, from, to)
+	if desc then
+		return redis.call("ZREVRANGE", key, from, to)
+	end
+	return redis.call("ZRANGE", key, from, to)
+end
+
+local function result(total, ids)
+	return {tostring(total), unpack(ids)}
+end
+
+if #filters <= 1 and not by_slots and min_slots <= 1 then
+	local key = filters[1] or KEYS[3]
+	return result(redis.call("ZCARD", key), range(key, start, start + limit - 1))
+end
+
+if #filters == 0 then
+	local total = redis.call("ZCOUNT", KEYS[2], min_slots, "+inf")
+	if by_slots then
+		if desc then
+			return result(total, redis.call("ZREVRANGEBYSCORE", KEYS[2], "+inf", min_slots, "LIMIT", start, limit))
+		end
+		return result(total, redis.call("ZRANGEBYSCORE", KEYS[2], min_slots, "+inf", "LIMIT", start, limit))
+	end
+
+	-- walk the lobbies by age, skipping those with too few open slots
+	local ids, seen, pos = {}, 0, 0
+	while #ids < limit do
+		local batch = range(KEYS[3], pos, pos + chunk - 1)
+		if #batch == 0 then
+			break
+		end
+		for _, id in ipairs(batch) do
+			local slots = tonumber(redis.call("ZSCORE", KEYS[2], id))
+			if slots and slots >= min_slots then
+				if seen >= start and #ids < limit then
+					ids[#ids + 1] = id
+				end
+				seen = seen + 1
+			end
+		end
+		pos = pos + chunk
+	end
+	return result(total, ids)
+end
+
+local need_slots = by_slots or min_slots > 1
+local args = {KEYS[1], #filters + (need_slots and 1 or 0)}
+for _, key in ipairs(filters) do
+	args[#args + 1] = key
+end
+if need_slots then
+	args[#args + 1] = KEYS[2]
+end
+args[#args + 1] = "WEIGHTS"
+for _ in ipairs(filters) do
+	args[#args + 1] = need_slots and 0 or 1
+end
+if need_slots then
+	args[#args + 1] = 1
+end
+args[#args + 1] = "AGGREGATE"
+args[#args + 1] = "MAX"
+redis.call("ZINTERSTORE", unpack(args))
+if need_slots then
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. min_slots)
+	if not by_slots then
+		redis.call("ZINTERSTORE", KEYS[1], 2, KEYS[1], filters[1], "WEIGHTS", 0, 1)
+	end
+end
+local total = redis.call("ZCARD", KEYS[1])
+local ids = range(KEYS[1], start, start + limit - 1)
+redis.call("DEL", KEYS[1])
+return result(total, ids)
+`)
+
+func (s *Service) List(req models.ListLobbiesRequest) ([]models.Lobby, int, error) {
+	keys := []string{"lobby_index:query:" + uuid.NewString(), indexSlotsKey, indexAllKey}
+	for name, value := range map[string]string{
+		"mode":   req.Mode,
+		"region": req.Region,
+		"map":    req.Map,
+		"lang":   req.Language,
+	} {
+		if value != "" {
+			keys = append(keys, indexKey(name, value))
+		}
+	}
+	if req.Ranked != nil {
+		ranked := "0"
+		if *req.Ranked {
+			ranked = "1"
+		}
+		keys = append(keys, indexKey("ranked", ranked))
+	}
+
+	res, err := listScript.Run(context.Background(), s.rdb, keys,
+		req.OpenSlots, req.Sort, (req.Page-1)*req.Limit, req.Limit, listScriptChunk,
+	).StringSlice()
+	if err != nil {
+		return nil, 0, fmt.Errorf("redis list lobbies: %w", err)
+	}
+	total, _ := strconv.Atoi(res[0])
+
+	found, err := s.getMany(res[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lobbies := []models.Lobby{}
+	for _, lobby := range found {
+		if lobby == nil {
+			// closed since it was listed
+			continue
+		}
+		lobby.InviteCode = ""
+		lobbies = append(lobbies, *lobby)
+	}
+
+	return lobbies, total, nil
+}
+
+// indexKeys is worked out in Go so values are lowercased like the filters.
+func indexKeys(mode string, ranked string, region string, mapName string, language string) []string {
+	keys := []string{indexAllKey, indexKey("mode", mode), indexKey("ranked", ranked)}
+	for name, value := range map[string]string{
+		"region": region,
+		"map":    mapName,
+		"lang":   language,
+	} {
+		if value != "" {
+			keys = append(keys, indexKey(name, value))
+		}
+	}
+
+	return keys
+}
+
+func indexKey(name string, value string) string {
+	return "lobby_index:" + name + ":" + strings.ToLower(value)
+}
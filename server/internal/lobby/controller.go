@@ -1,42 +1,461 @@
 package lobby
 
 import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
 	"net/http"
-
+	"server/internal/env"
+	"server/internal/middlewares"
+	"server/internal/models"
 	"server/pkg/betools"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
-type Controller struct{}
+type Controller struct {
+	svc *Service
+}
 
-func NewController() *Controller {
-	return &Controller{}
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
 }
 
 func (c *Controller) GetRoutes() []betools.Route {
-	return []betools.Route{
-		{
-			Method:      "POST",
-			Pattern:     "/lobby/create",
-			HandlerFunc: c.handleCreateLobby,
+	routes := betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "GET",
+				Pattern:     "/lobby",
+				HandlerFunc: c.handleListLobbies,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/create",
+				HandlerFunc: c.handleCreateLobby,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.CreateLobbyRequest](),
+				},
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/lobby/{lobbyId}",
+				HandlerFunc: c.handleGetLobby,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/join/{lobbyId}",
+				HandlerFunc: c.handleJoinLobby,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.JoinLobbyRequest](betools.BodyParserOptions{
+						Validate: true,
+						Optional: true,
+					}),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/leave/{lobbyId}",
+				HandlerFunc: c.handleLeaveLobby,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/transfer/{lobbyId}",
+				HandlerFunc: c.handleTransferHost,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.LobbyMemberRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/kick/{lobbyId}",
+				HandlerFunc: c.handleKickMember,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.LobbyMemberRequest](),
+				},
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/ready-check/{lobbyId}",
+				HandlerFunc: c.handleStartReadyCheck,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/cancel/{lobbyId}",
+				HandlerFunc: c.handleCancelReadyCheck,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/lobby/ready/{lobbyId}",
+				HandlerFunc: c.handleSetReady,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.SetReadyRequest](),
+				},
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/lobby/{lobbyId}/events",
+				HandlerFunc: c.handleEvents,
+			},
 		},
-		{
-			Method:      "POST",
-			Pattern:     "/lobby/join/{lobbyId}",
-			HandlerFunc: c.handleJoinLobby,
+	)
+
+	return append(routes, betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.APIKeyMiddleware,
+			middlewares.RequireScope(models.ScopeLobbyWrite),
 		},
-		{
-			Method:      "POST",
-			Pattern:     "/lobby/leave/{lobbyId}",
-			HandlerFunc: c.handleLeaveLobby,
+		[]betools.Route{
+			{
+				Method:      "PUT",
+				Pattern:     "/service/lobbies/{lobbyId}/status",
+				HandlerFunc: c.handleServiceReportStatus,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.ReportLobbyStatusRequest](),
+				},
+			},
 		},
+	)...)
+}
+
+func (c *Controller) handleListLobbies(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req := models.ListLobbiesRequest{
+		Mode:      query.Get("mode"),
+		Region:    query.Get("region"),
+		Map:       query.Get("map"),
+		Language:  query.Get("language"),
+		OpenSlots: 1,
+		Sort:      "newest",
+		Page:      1,
+		Limit:     20,
+	}
+	if param := query.Get("sort"); param != "" {
+		req.Sort = param
+	}
+	if param := query.Get("ranked"); param != "" {
+		ranked, err := strconv.ParseBool(param)
+		if err != nil {
+			slog.Error("list lobbies", "ranked", param, "error", err)
+			betools.SendErrorResponse(w, http.StatusBadRequest, "ranked must be true or false")
+			return
+		}
+		req.Ranked = &ranked
 	}
+	for name, field := range map[string]*int{
+		"open_slots": &req.OpenSlots,
+		"page":       &req.Page,
+		"limit":      &req.Limit,
+	} {
+		if param := query.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				slog.Error("list lobbies", name, param, "error", err)
+				betools.SendErrorResponse(w, http.StatusBadRequest, name+" must be an integer")
+				return
+			}
+			*field = n
+		}
+	}
+
+	if fieldErrors := betools.Validate(&req); len(fieldErrors) > 0 {
+		betools.SendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"validation failed",
+			betools.SliceMap(fieldErrors, func(el betools.ValidationError) betools.FieldError {
+				return betools.FieldError(el)
+			})...,
+		)
+		return
+	}
+
+	res, total, err := c.svc.List(req)
+	if err != nil {
+		slog.Error("list lobbies", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list lobbies")
+		return
+	}
+
+	betools.SendOKResponse(w, res, betools.Pagination{
+		Total: total,
+		Page:  req.Page,
+		Limit: req.Limit,
+	})
 }
 
 func (c *Controller) handleCreateLobby(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.CreateLobbyRequest](r)
+	player := betools.GetAuthCtx(r)
+
+	res, err := c.svc.Create(player, req)
+	if err != nil {
+		slog.Error("create lobby", "uid", player.UserID, "error", err)
+		sendLobbyError(w, err, "failed to create lobby")
+		return
+	}
+
+	slog.Info("lobby created", "uid", player.UserID, "lobby_id", res.ID)
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleGetLobby(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.Get(id)
+	if err != nil {
+		slog.Error("get lobby", "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to get lobby")
+		return
+	}
+	if !res.HasMember(uid) {
+		res.InviteCode = ""
+	}
+
+	betools.SendOKResponse(w, res)
 }
 
 func (c *Controller) handleJoinLobby(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.JoinLobbyRequest](r)
+	player := betools.GetAuthCtx(r)
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.Join(player, id, req.Password)
+	if err != nil {
+		slog.Error("join lobby", "uid", player.UserID, "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to join lobby")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
 }
 
 func (c *Controller) handleLeaveLobby(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	if err := c.svc.Leave(uid, id); err != nil {
+		slog.Error("leave lobby", "uid", uid, "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to leave lobby")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleTransferHost(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.LobbyMemberRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.TransferHost(uid, id, req.UserID)
+	if err != nil {
+		slog.Error("transfer lobby host", "uid", uid, "lobby_id", id, "target", req.UserID, "error", err)
+		sendLobbyError(w, err, "failed to transfer lobby")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleKickMember(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.LobbyMemberRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.Kick(uid, id, req.UserID)
+	if err != nil {
+		slog.Error("kick lobby member", "uid", uid, "lobby_id", id, "target", req.UserID, "error", err)
+		sendLobbyError(w, err, "failed to kick member")
+		return
+	}
+
+	slog.Info("lobby member kicked", "uid", uid, "lobby_id", id, "target", req.UserID)
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleStartReadyCheck(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.StartReadyCheck(uid, id)
+	if err != nil {
+		slog.Error("start ready check", "uid", uid, "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to start ready check")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleCancelReadyCheck(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.CancelReadyCheck(uid, id)
+	if err != nil {
+		slog.Error("cancel ready check", "uid", uid, "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to cancel ready check")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleSetReady(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.SetReadyRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	res, err := c.svc.SetReady(uid, id, req.Ready)
+	if err != nil {
+		slog.Error("set ready", "uid", uid, "lobby_id", id, "ready", req.Ready, "error", err)
+		sendLobbyError(w, err, "failed to set ready")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleServiceReportStatus(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ReportLobbyStatusRequest](r)
+	service := betools.GetServiceCtx(r)
+	id := chi.URLParam(r, "lobbyId")
+
+	if err := c.svc.ReportStatus(id, req.Status); err != nil {
+		slog.Error("service report lobby status", "key_id", service.KeyID, "lobby_id", id, "status", req.Status, "error", err)
+		sendLobbyError(w, err, "failed to report lobby status")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+// handleEvents streams a snapshot, then every change of the lobby, over SSE.
+func (c *Controller) handleEvents(w http.ResponseWriter, r *http.Request) {
+	auth := betools.GetAuthCtx(r)
+	uid := auth.UserID
+	id := chi.URLParam(r, "lobbyId")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("lobby events", "error", "streaming unsupported")
+		betools.SendErrorResponse(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	sub := c.svc.Subscribe(r.Context(), id)
+	defer sub.Close()
+
+	// subscribed before taking the snapshot, so no change falls in between
+	if _, err := sub.Receive(r.Context()); err != nil {
+		slog.Error("lobby events", "lobby_id", id, "error", err)
+		betools.SendErrorResponse(w, http.StatusInternalServerError, "failed to subscribe")
+		return
+	}
+
+	snapshot, err := c.svc.Get(id)
+	if err != nil {
+		slog.Error("lobby events", "uid", uid, "lobby_id", id, "error", err)
+		sendLobbyError(w, err, "failed to get lobby")
+		return
+	}
+	if !snapshot.HasMember(uid) {
+		slog.Error("lobby events", "uid", uid, "lobby_id", id, "error", ErrNotMember)
+		sendLobbyError(w, ErrNotMember, "failed to get lobby")
+		return
+	}
+
+	betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+		Event: "snapshot",
+		Data:  snapshot,
+	})
+
+	recheck := time.NewTicker(time.Duration(env.C.StreamAuthRecheckSeconds) * time.Second)
+	defer recheck.Stop()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-recheck.C:
+			if err := middlewares.Recheck(auth); err != nil {
+				slog.Error("lobby events", "uid", uid, "lobby_id", id, "error", err)
+				betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+					Event: "error",
+					Error: err,
+				})
+				return
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			event := models.LobbyEvent{}
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				slog.Error("lobby events", "lobby_id", id, "error", err)
+				continue
+			}
+
+			betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+				Event: "lobby",
+				Data:  event,
+			})
+
+			switch event.Type {
+			case models.LobbyEventClosed:
+				return
+			case models.LobbyEventMemberLeft, models.LobbyEventMemberKicked:
+				if event.UserID == uid {
+					return
+				}
+			}
+		}
+	}
+}
+
+func sendLobbyError(w http.ResponseWriter, err error, fallback string) {
+	var rankedBan *models.BannedError
+	var throttled *JoinThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		retryAfter := int(math.Ceil(throttled.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		betools.SendErrorCodeResponse(w, http.StatusTooManyRequests, "join_throttled", "too many failed joins", map[string]int{
+			"retry_after_seconds": retryAfter,
+		})
+	case errors.As(err, &rankedBan):
+		betools.SendErrorCodeResponse(w, http.StatusForbidden, "ranked_banned", "banned from ranked", models.BannedDetails{
+			Kind:   rankedBan.Sanction.Kind,
+			Reason: rankedBan.Sanction.Reason,
+			EndsAt: rankedBan.Sanction.EndsAt,
+		})
+	case errors.Is(err, ErrNotFound):
+		betools.SendErrorResponse(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrFull), errors.Is(err, ErrNotOpen), errors.Is(err, ErrAlreadyInLobby), errors.Is(err, ErrNotMember),
+		errors.Is(err, ErrTargetNotMember), errors.Is(err, ErrNotEnoughPlayers), errors.Is(err, ErrNoReadyCheck),
+		errors.Is(err, ErrInvalidTransition):
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+	case errors.Is(err, ErrTargetSelf):
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+	case errors.Is(err, ErrNotHost), errors.Is(err, ErrKicked), errors.Is(err, ErrGuestRanked), errors.Is(err, ErrEmailUnverified),
+		errors.Is(err, ErrInviteRequired), errors.Is(err, ErrWrongPassword):
+		betools.SendErrorResponse(w, http.StatusForbidden, err)
+	default:
+		betools.SendErrorResponse(w, http.StatusBadRequest, fallback)
+	}
 }
@@ -0,0 +1,368 @@
+package lobby
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"server/internal/env"
+	"server/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Lobbies waiting on a deadline are in lobby_deadlines, scored on the Valkey
+// clock. Launches are added to the lobby_launches stream for the allocators.
+const (
+	deadlinesKey       = "lobby_deadlines"
+	LaunchStream       = "lobby_launches"
+	launchStreamMaxLen = 10000
+)
+
+// lifecycleLua is shared by the scripts that change a lobby. They are given
+// the keys from scriptKeys and the lobby ID as ARGV[1].
+const lifecycleLua = `
+local function now_ms()
+	local t = redis.call("TIME")
+	return tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+
+local function publish(event)
+	event.lobby_id = ARGV[1]
+	redis.call("PUBLISH", "lobby_events:" .. ARGV[1], cjson.encode(event))
+end
+
+-- index_keys returns the browser indexes the lobby belongs in, stored with
+-- it on create, see indexKeys.
+local function index_keys()
+	return cjson.decode(redis.call("HGET", KEYS[1], "index"))
+end
+
+local function unindex()
+	for _, key in ipairs(index_keys()) do
+		redis.call("ZREM", key, ARGV[1])
+	end
+	redis.call("ZREM", "lobby_index:slots", ARGV[1])
+end
+
+-- index lists the lobby in the browser while it is public, open and not
+-- full, with its open slots kept up to date, and takes it out otherwise.
+local function index()
+	local l = redis.call("HMGET", KEYS[1], "visibility", "status", "created_at", "capacity")
+	local slots = tonumber(l[4]) - redis.call("ZCARD", KEYS[2])
+	if l[1] ~= "public" or l[2] ~= "open" or slots < 1 then
+		unindex()
+		return
+	end
+	for _, key in ipairs(index_keys()) do
+		redis.call("ZADD", key, l[3], ARGV[1])
+	end
+	redis.call("ZADD", "lobby_index:slots", slots, ARGV[1])
+end
+
+-- set_status moves the lobby to status, due to move on by itself once the
+-- milliseconds in its timeout_field have passed, if given.
+local function set_status(status, timeout_field)
+	local deadline = nil
+	if timeout_field then
+		deadline = now_ms() + tonumber(redis.call("HGET", KEYS[1], timeout_field))
+		redis.call("HSET", KEYS[1], "status", status, "deadline", deadline)
+		redis.call("ZADD", KEYS[5], deadline, ARGV[1])
+	else
+		redis.call("HSET", KEYS[1], "status", status)
+		redis.call("HDEL", KEYS[1], "deadline")
+		redis.call("ZREM", KEYS[5], ARGV[1])
+	end
+	index()
+	publish({type = "status_changed", status = status, deadline_ms = deadline})
+end
+
+-- clear_ready drops every ready flag, telling the members.
+local function clear_ready()
+	for _, uid in ipairs(redis.call("SMEMBERS", KEYS[3])) do
+		publish({type = "ready_changed", uid = tonumber(uid), ready = false})
+	end
+	redis.call("DEL", KEYS[3])
+end
+
+local function reopen()
+	clear_ready()
+	set_status("open")
+end
+
+-- check_ready reopens a lobby left without enough players for its ready
+-- check, and starts the countdown once every member is ready.
+local function check_ready()
+	local status = redis.call("HGET", KEYS[1], "status")
+	if status ~= "ready_check" and status ~= "countdown" then
+		return
+	end
+	local count = redis.call("ZCARD", KEYS[2])
+	if count < tonumber(redis.call("HGET", KEYS[1], "min_players")) then
+		reopen()
+	elseif status == "ready_check" and redis.call("SCARD", KEYS[3]) == count then
+		set_status("countdown", "countdown_ms")
+	end
+end
+
+-- remove_member takes uid out of the lobby. A countdown under way goes back
+-- to the ready check, as when a member unreadies; the others stay ready, so
+-- it counts down again right away if they all are.
+local function remove_member(uid)
+	redis.call("ZREM", KEYS[2], uid)
+	redis.call("SREM", KEYS[3], uid)
+	if redis.call("HGET", KEYS[1], "status") == "countdown" then
+		set_status("ready_check", "ready_check_ms")
+	end
+	check_ready()
+	index()
+end
+
+-- close drops the lobby and returns the members it freed.
+local function close()
+	local members = redis.call("ZRANGE", KEYS[2], 0, -1)
+	for _, member in ipairs(members) do
+		local key = "player_lobby:" .. member
+		if redis.call("GET", key) == ARGV[1] then
+			redis.call("DEL", key)
+		end
+	end
+	local code = redis.call("HGET", KEYS[1], "code")
+	if code then
+		redis.call("DEL", "lobby_code:" .. code)
+	end
+	unindex()
+	redis.call("DEL", KEYS[1], KEYS[2], KEYS[3], KEYS[4])
+	redis.call("ZREM", KEYS[5], ARGV[1])
+	publish({type = "lobby_closed"})
+	return members
+end
+`
+
+// readyCheckScript lets the host ARGV[2] start (ARGV[3] == "start") or call
+// off (ARGV[3] == "cancel") the ready check.
+var readyCheckScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return "not_found"
+end
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+	return "not_host"
+end
+local status = redis.call("HGET", KEYS[1], "status")
+if ARGV[3] == "cancel" then
+	if status ~= "ready_check" and status ~= "countdown" then
+		return "no_ready_check"
+	end
+	reopen()
+	return "ok"
+end
+if status ~= "open" then
+	return "not_open"
+end
+if redis.call("ZCARD", KEYS[2]) < tonumber(redis.call("HGET", KEYS[1], "min_players")) then
+	return "not_enough_players"
+end
+clear_ready()
+set_status("ready_check", "ready_check_ms")
+return "ok"
+`)
+
+// readyScript sets the ready flag of ARGV[2] to ARGV[3]. Unreadying during
+// the countdown calls it off.
+var readyScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return "not_found"
+end
+if not redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+	return "not_member"
+end
+local status = redis.call("HGET", KEYS[1], "status")
+if status ~= "ready_check" and status ~= "countdown" then
+	return "no_ready_check"
+end
+if ARGV[3] == "1" then
+	if redis.call("SADD", KEYS[3], ARGV[2]) == 1 then
+		publish({type = "ready_changed", uid = tonumber(ARGV[2]), ready = true})
+	end
+	check_ready()
+elseif redis.call("SREM", KEYS[3], ARGV[2]) == 1 then
+	publish({type = "ready_changed", uid = tonumber(ARGV[2]), ready = false})
+	if status == "countdown" then
+		set_status("ready_check", "ready_check_ms")
+	end
+end
+return "ok"
+`)
+
+// deadlineScript moves the lobby on if its deadline has passed: a countdown
+// to launching, adding the launch to the stream at KEYS[7] capped at ARGV[2]
+// entries, a ready check or launch nobody completed back to open. It returns
+// the new status, or nothing.
+var deadlineScript = redis.NewScript(lifecycleLua + `
+local deadline = redis.call("HGET", KEYS[1], "deadline")
+if not deadline then
+	redis.call("ZREM", KEYS[5], ARGV[1])
+	return ""
+end
+if tonumber(deadline) > now_ms() then
+	return ""
+end
+if redis.call("HGET", KEYS[1], "status") == "countdown" then
+	set_status("launching", "launch_timeout_ms")
+	local l = redis.call("HMGET", KEYS[1], "mode", "ranked", "capacity", "region", "map", "language")
+	local members = {}
+	for i, uid in ipairs(redis.call("ZRANGE", KEYS[2], 0, -1)) do
+		members[i] = tonumber(uid)
+	end
+	redis.call("XADD", KEYS[7], "MAXLEN", "~", ARGV[2], "*", "launch", cjson.encode({
+		lobby_id = ARGV[1], mode = l[1], ranked = l[2] == "1", capacity = tonumber(l[3]),
+		region = l[4] or "", map = l[5] or "", language = l[6] or "", members = members,
+	}))
+	return "launching"
+end
+reopen()
+return "open"
+`)
+
+// reportScript moves a launching lobby in game, or closes a launching or in
+// game one, as reported by its game server (ARGV[2]). It returns the new
+// status followed by the members.
+var reportScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {"not_found"}
+end
+local status = redis.call("HGET", KEYS[1], "status")
+if ARGV[2] == "in_game" then
+	if status ~= "launching" then
+		return {"bad_transition"}
+	end
+	set_status("in_game")
+	return {"in_game", unpack(redis.call("ZRANGE", KEYS[2], 0, -1))}
+end
+if status ~= "launching" and status ~= "in_game" then
+	return {"bad_transition"}
+end
+set_status("closed")
+return {"closed", unpack(close())}
+`)
+
+func (s *Service) StartReadyCheck(uid int, id string) (*models.Lobby, error) {
+	return s.runReadyCheckScript(uid, id, "start")
+}
+
+func (s *Service) CancelReadyCheck(uid int, id string) (*models.Lobby, error) {
+	return s.runReadyCheckScript(uid, id, "cancel")
+}
+
+func (s *Service) runReadyCheckScript(uid int, id string, action string) (*models.Lobby, error) {
+	res, err := readyCheckScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, uid),
+		id, uid, action,
+	).Text()
+	if err != nil {
+		return nil, fmt.Errorf("redis %s ready check: %w", action, err)
+	}
+	if err, ok := scriptErrors[res]; ok {
+		return nil, err
+	}
+
+	return s.Get(id)
+}
+
+func (s *Service) SetReady(uid int, id string, ready bool) (*models.Lobby, error) {
+	flag := "0"
+	if ready {
+		flag = "1"
+	}
+
+	res, err := readyScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, uid),
+		id, uid, flag,
+	).Text()
+	if err != nil {
+		return nil, fmt.Errorf("redis set ready: %w", err)
+	}
+	if err, ok := scriptErrors[res]; ok {
+		return nil, err
+	}
+
+	return s.Get(id)
+}
+
+// ReportStatus is called by the game server hosting the lobby's match.
+func (s *Service) ReportStatus(id string, status string) error {
+	res, err := reportScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, 0),
+		id, status,
+	).StringSlice()
+	if err != nil {
+		return fmt.Errorf("redis report lobby status: %w", err)
+	}
+	if err, ok := scriptErrors[res[0]]; ok {
+		return err
+	}
+
+	presenceStatus, activity := models.PresenceInMatch, id
+	if res[0] == models.LobbyClosed {
+		presenceStatus, activity = models.PresenceOnline, ""
+	}
+	for _, member := range res[1:] {
+		if uid, err := strconv.Atoi(member); err == nil {
+			s.setActivity(uid, presenceStatus, activity)
+		}
+	}
+
+	slog.Info("lobby status reported", "lobby_id", id, "status", res[0])
+
+	return nil
+}
+
+// RunScheduler moves lobbies on when their deadline passes.
+func (s *Service) RunScheduler() {
+	ticker := time.NewTicker(time.Duration(env.C.LobbySchedulerTickMillis) * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.runDeadlines(); err != nil {
+			slog.Error("lobby scheduler", "error", err)
+		}
+	}
+}
+
+func (s *Service) runDeadlines() error {
+	// deadlines are on the Valkey clock, see deadlinesKey
+	now, err := s.rdb.Time(context.Background()).Result()
+	if err != nil {
+		return fmt.Errorf("redis time: %w", err)
+	}
+
+	due, err := s.rdb.ZRangeByScore(context.Background(), deadlinesKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("redis zrangebyscore: %w", err)
+	}
+
+	// a failed lobby is tried again on the next tick
+	for _, id := range due {
+		status, err := deadlineScript.Run(context.Background(), s.rdb,
+			append(scriptKeys(id, 0), LaunchStream),
+			id, launchStreamMaxLen,
+		).Text()
+		if err != nil {
+			slog.Error("lobby deadline", "lobby_id", id, "error", err)
+			continue
+		}
+
+		switch status {
+		case models.LobbyLaunching:
+			slog.Info("lobby launching", "lobby_id", id)
+		case models.LobbyOpen:
+			slog.Info("lobby reopened", "lobby_id", id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,340 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"server/internal/env"
+	"server/internal/models"
+	"server/internal/presence"
+	"server/pkg/betools"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The tests below run the lobby scripts against a real Valkey, given as
+// VALKEY_TEST_ADDR (host:port). They use database 15 and flush it, so point
+// them at a throwaway instance.
+const testValkeyDB = 15
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	addr := os.Getenv("VALKEY_TEST_ADDR")
+	if addr == "" {
+		t.Skip("VALKEY_TEST_ADDR not set")
+	}
+
+	env.C = &env.Env{
+		PresenceTTLSeconds:        60,
+		LobbyMinPlayers:           2,
+		LobbyReadyCheckSeconds:    30,
+		LobbyCountdownSeconds:     0,
+		LobbyLaunchTimeoutSeconds: 60,
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: addr, DB: testValkeyDB})
+	if err := rdb.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	t.Cleanup(func() {
+		rdb.FlushDB(context.Background())
+		rdb.Close()
+	})
+
+	return NewService(rdb, nil, presence.NewService(rdb))
+}
+
+func createTestLobby(t *testing.T, s *Service, host int, req models.CreateLobbyRequest) *models.Lobby {
+	t.Helper()
+
+	if req.Mode == "" {
+		req.Mode = "deathmatch"
+	}
+	if req.Capacity == 0 {
+		req.Capacity = 4
+	}
+
+	lobby, err := s.Create(betools.AuthInfo{UserID: host}, req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// created_at is in milliseconds, keep the lobbies apart
+	time.Sleep(2 * time.Millisecond)
+
+	return lobby
+}
+
+func joinTestLobby(t *testing.T, s *Service, id string, uids ...int) *models.Lobby {
+	t.Helper()
+
+	var lobby *models.Lobby
+	for _, uid := range uids {
+		var err error
+		if lobby, err = s.Join(betools.AuthInfo{UserID: uid}, id, ""); err != nil {
+			t.Fatalf("join %d: %v", uid, err)
+		}
+	}
+
+	return lobby
+}
+
+func readyOf(lobby *models.Lobby) map[int]bool {
+	ready := map[int]bool{}
+	for _, m := range lobby.Members {
+		ready[m.UserID] = m.Ready
+	}
+	return ready
+}
+
+func TestJoinLeaveAndHostElection(t *testing.T) {
+	s := newTestService(t)
+
+	lobby := createTestLobby(t, s, 1, models.CreateLobbyRequest{Capacity: 3})
+	joinTestLobby(t, s, lobby.ID, 2, 3)
+
+	if _, err := s.Join(betools.AuthInfo{UserID: 4}, lobby.ID, ""); !errors.Is(err, ErrFull) {
+		t.Fatalf("join full lobby: got %v, want %v", err, ErrFull)
+	}
+	if _, err := s.Create(betools.AuthInfo{UserID: 2}, models.CreateLobbyRequest{Mode: "ctf", Capacity: 2}); !errors.Is(err, ErrAlreadyInLobby) {
+		t.Fatalf("create while in a lobby: got %v, want %v", err, ErrAlreadyInLobby)
+	}
+
+	// the longest-tenured member takes over from the host
+	for _, want := range []int{2, 3} {
+		host, _ := s.Get(lobby.ID)
+		if err := s.Leave(host.Host, lobby.ID); err != nil {
+			t.Fatalf("leave: %v", err)
+		}
+		got, err := s.Get(lobby.ID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got.Host != want {
+			t.Fatalf("host: got %d, want %d", got.Host, want)
+		}
+	}
+
+	if err := s.Leave(3, lobby.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if _, err := s.Get(lobby.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get after the last member left: got %v, want %v", err, ErrNotFound)
+	}
+	if n := s.rdb.Exists(context.Background(), playerLobbyKey(3), codeKey(lobby.InviteCode)).Val(); n != 0 {
+		t.Fatalf("%d keys left behind by a closed lobby", n)
+	}
+}
+
+func TestKick(t *testing.T) {
+	s := newTestService(t)
+
+	lobby := createTestLobby(t, s, 1, models.CreateLobbyRequest{})
+	joinTestLobby(t, s, lobby.ID, 2)
+
+	if _, err := s.Kick(2, lobby.ID, 1); !errors.Is(err, ErrNotHost) {
+		t.Fatalf("kick by a member: got %v, want %v", err, ErrNotHost)
+	}
+	if _, err := s.Kick(1, lobby.ID, 2); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+	if _, err := s.Join(betools.AuthInfo{UserID: 2}, lobby.ID, ""); !errors.Is(err, ErrKicked) {
+		t.Fatalf("join after a kick: got %v, want %v", err, ErrKicked)
+	}
+}
+
+func TestReadyCheck(t *testing.T) {
+	s := newTestService(t)
+
+	lobby := createTestLobby(t, s, 1, models.CreateLobbyRequest{})
+
+	if _, err := s.StartReadyCheck(1, lobby.ID); !errors.Is(err, ErrNotEnoughPlayers) {
+		t.Fatalf("start alone: got %v, want %v", err, ErrNotEnoughPlayers)
+	}
+	joinTestLobby(t, s, lobby.ID, 2, 3)
+	if _, err := s.StartReadyCheck(2, lobby.ID); !errors.Is(err, ErrNotHost) {
+		t.Fatalf("start by a member: got %v, want %v", err, ErrNotHost)
+	}
+	if _, err := s.StartReadyCheck(1, lobby.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	for _, uid := range []int{1, 2, 3} {
+		if lobby, err := s.SetReady(uid, lobby.ID, true); err != nil {
+			t.Fatalf("ready %d: %v", uid, err)
+		} else if uid < 3 && lobby.Status != models.LobbyReadyCheck {
+			t.Fatalf("status with %d ready: got %s", uid, lobby.Status)
+		}
+	}
+	got, _ := s.Get(lobby.ID)
+	if got.Status != models.LobbyCountdown {
+		t.Fatalf("status with everyone ready: got %s, want %s", got.Status, models.LobbyCountdown)
+	}
+
+	// unreadying calls the countdown off
+	got, err := s.SetReady(3, lobby.ID, false)
+	if err != nil {
+		t.Fatalf("unready: %v", err)
+	}
+	if got.Status != models.LobbyReadyCheck {
+		t.Fatalf("status after unready: got %s, want %s", got.Status, models.LobbyReadyCheck)
+	}
+
+	// the others stay ready when a member leaves, so they count down again
+	if err := s.Leave(3, lobby.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	got, _ = s.Get(lobby.ID)
+	if got.Status != models.LobbyCountdown {
+		t.Fatalf("status after the unready member left: got %s, want %s", got.Status, models.LobbyCountdown)
+	}
+	if ready := readyOf(got); !ready[1] || !ready[2] {
+		t.Fatalf("ready flags after a leave: got %v", ready)
+	}
+
+	// too few players left reopens the lobby and clears the flags
+	if err := s.Leave(2, lobby.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	got, _ = s.Get(lobby.ID)
+	if got.Status != models.LobbyOpen || got.Deadline != nil {
+		t.Fatalf("status below min players: got %s, deadline %v", got.Status, got.Deadline)
+	}
+	if readyOf(got)[1] {
+		t.Fatal("ready flag kept after the lobby reopened")
+	}
+}
+
+func TestCountdownLaunches(t *testing.T) {
+	s := newTestService(t)
+
+	lobby := createTestLobby(t, s, 1, models.CreateLobbyRequest{Mode: "ctf", Capacity: 2, Region: "eu"})
+	joinTestLobby(t, s, lobby.ID, 2)
+	if _, err := s.StartReadyCheck(1, lobby.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	for _, uid := range []int{1, 2} {
+		if _, err := s.SetReady(uid, lobby.ID, true); err != nil {
+			t.Fatalf("ready %d: %v", uid, err)
+		}
+	}
+
+	// LobbyCountdownSeconds is 0, so the countdown is due right away
+	if err := s.runDeadlines(); err != nil {
+		t.Fatalf("run deadlines: %v", err)
+	}
+	got, _ := s.Get(lobby.ID)
+	if got.Status != models.LobbyLaunching {
+		t.Fatalf("status after the countdown: got %s, want %s", got.Status, models.LobbyLaunching)
+	}
+
+	entries, err := s.rdb.XRange(context.Background(), LaunchStream, "-", "+").Result()
+	if err != nil {
+		t.Fatalf("xrange: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("launches: got %d, want 1", len(entries))
+	}
+	launch := models.LobbyLaunch{}
+	if err := json.Unmarshal([]byte(entries[0].Values["launch"].(string)), &launch); err != nil {
+		t.Fatalf("decode launch: %v", err)
+	}
+	if launch.LobbyID != lobby.ID || launch.Mode != "ctf" || launch.Region != "eu" || len(launch.Members) != 2 {
+		t.Fatalf("launch: got %+v", launch)
+	}
+
+	if err := s.ReportStatus(lobby.ID, models.LobbyInGame); err != nil {
+		t.Fatalf("report in game: %v", err)
+	}
+	if err := s.ReportStatus(lobby.ID, models.LobbyClosed); err != nil {
+		t.Fatalf("report closed: %v", err)
+	}
+	if _, err := s.Get(lobby.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get after the match: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newTestService(t)
+
+	full := createTestLobby(t, s, 1, models.CreateLobbyRequest{Capacity: 2, Region: "EU"})
+	joinTestLobby(t, s, full.ID, 2)
+	ctf := createTestLobby(t, s, 3, models.CreateLobbyRequest{Mode: "ctf", Capacity: 4, Region: "eu"})
+	us := createTestLobby(t, s, 4, models.CreateLobbyRequest{Capacity: 8, Region: "us"})
+	joinTestLobby(t, s, us.ID, 5, 6)
+	createTestLobby(t, s, 7, models.CreateLobbyRequest{Visibility: models.LobbyUnlisted})
+	small := createTestLobby(t, s, 8, models.CreateLobbyRequest{Capacity: 2, Region: "us"})
+
+	// free slots: ctf 3, us 5, small 1; full and unlisted are left out
+	tests := []struct {
+		name string
+		req  models.ListLobbiesRequest
+		want []string
+	}{
+		{"newest", models.ListLobbiesRequest{}, []string{small.ID, us.ID, ctf.ID}},
+		{"oldest", models.ListLobbiesRequest{Sort: "oldest"}, []string{ctf.ID, us.ID, small.ID}},
+		{"fullest", models.ListLobbiesRequest{Sort: "fullest"}, []string{small.ID, ctf.ID, us.ID}},
+		{"emptiest", models.ListLobbiesRequest{Sort: "emptiest"}, []string{us.ID, ctf.ID, small.ID}},
+		{"one filter", models.ListLobbiesRequest{Region: "EU"}, []string{ctf.ID}},
+		{"two filters", models.ListLobbiesRequest{Mode: "deathmatch", Region: "us"}, []string{small.ID, us.ID}},
+		{"open slots", models.ListLobbiesRequest{OpenSlots: 3}, []string{us.ID, ctf.ID}},
+		{"open slots oldest", models.ListLobbiesRequest{OpenSlots: 3, Sort: "oldest"}, []string{ctf.ID, us.ID}},
+		{"filter and open slots", models.ListLobbiesRequest{Region: "us", OpenSlots: 2}, []string{us.ID}},
+		{"filter by slots", models.ListLobbiesRequest{Region: "us", Sort: "emptiest"}, []string{us.ID, small.ID}},
+		{"second page", models.ListLobbiesRequest{Page: 2, Limit: 2}, []string{ctf.ID}},
+		{"open slots second page", models.ListLobbiesRequest{OpenSlots: 2, Page: 2, Limit: 1}, []string{ctf.ID}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if req.OpenSlots == 0 {
+				req.OpenSlots = 1
+			}
+			if req.Sort == "" {
+				req.Sort = "newest"
+			}
+			if req.Page == 0 {
+				req.Page = 1
+			}
+			if req.Limit == 0 {
+				req.Limit = 20
+			}
+
+			lobbies, _, err := s.List(req)
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			got := []string{}
+			for _, l := range lobbies {
+				got = append(got, l.ID)
+				if l.InviteCode != "" {
+					t.Errorf("invite code of %s listed", l.ID)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// a lobby with room again is listed again
+	if err := s.Leave(2, full.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	_, total, err := s.List(models.ListLobbiesRequest{OpenSlots: 1, Sort: "newest", Page: 1, Limit: 20})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if total != 4 {
+		t.Fatalf("total after a leave: got %d, want 4", total)
+	}
+}
@@ -0,0 +1,499 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"server/internal/enforcement"
+	"server/internal/env"
+	"server/internal/models"
+	"server/internal/passhash"
+	"server/internal/presence"
+	"server/pkg/betools"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// A lobby lives in Valkey only, and every change goes through a script that
+// publishes it on lobby_events:<id>.
+
+var (
+	ErrNotFound          = errors.New("lobby not found")
+	ErrFull              = errors.New("lobby full")
+	ErrNotOpen           = errors.New("lobby not open")
+	ErrAlreadyInLobby    = errors.New("already in another lobby")
+	ErrNotMember         = errors.New("not a member of the lobby")
+	ErrNotHost           = errors.New("only the host can do this")
+	ErrKicked            = errors.New("kicked from the lobby")
+	ErrTargetNotMember   = errors.New("player not in the lobby")
+	ErrTargetSelf        = errors.New("cannot target yourself")
+	ErrNotEnoughPlayers  = errors.New("not enough players")
+	ErrNoReadyCheck      = errors.New("no ready check running")
+	ErrInvalidTransition = errors.New("lobby cannot move to that status")
+	ErrGuestRanked       = errors.New("guests cannot play ranked")
+	ErrEmailUnverified   = errors.New("verify your email to play ranked")
+)
+
+var scriptErrors = map[string]error{
+	"not_found":          ErrNotFound,
+	"full":               ErrFull,
+	"not_open":           ErrNotOpen,
+	"in_lobby":           ErrAlreadyInLobby,
+	"not_member":         ErrNotMember,
+	"not_host":           ErrNotHost,
+	"kicked":             ErrKicked,
+	"target_not_member":  ErrTargetNotMember,
+	"target_self":        ErrTargetSelf,
+	"not_enough_players": ErrNotEnoughPlayers,
+	"no_ready_check":     ErrNoReadyCheck,
+	"bad_transition":     ErrInvalidTransition,
+}
+
+// createScript creates the lobby with ARGV[2] as host, unless they are in a
+// lobby already, and claims its invite code at KEYS[7].
+var createScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[6]) == 1 then
+	return "in_lobby"
+end
+if not redis.call("SET", KEYS[7], ARGV[1], "NX") then
+	return "code_taken"
+end
+redis.call("HSET", KEYS[1], "id", ARGV[1], "host", ARGV[2], "mode", ARGV[3], "ranked", ARGV[4],
+	"capacity", ARGV[5], "status", "open", "created_at", ARGV[6], "min_players", ARGV[7],
+	"ready_check_ms", ARGV[8], "countdown_ms", ARGV[9], "launch_timeout_ms", ARGV[10],
+	"visibility", ARGV[11], "code", ARGV[12], "password_hash", ARGV[13],
+	"region", ARGV[14], "map", ARGV[15], "language", ARGV[16], "index", ARGV[17])
+redis.call("ZADD", KEYS[2], ARGV[6], ARGV[2])
+redis.call("SET", KEYS[6], ARGV[1])
+index()
+return "ok"
+`)
+
+// joinScript adds ARGV[2] to the lobby if it is open, has room and did not
+// kick them. Joining the lobby the player is already in does nothing.
+var joinScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return "not_found"
+end
+local current = redis.call("GET", KEYS[6])
+if current == ARGV[1] then
+	return "ok"
+elseif current then
+	return "in_lobby"
+end
+if redis.call("SISMEMBER", KEYS[4], ARGV[2]) == 1 then
+	return "kicked"
+end
+if redis.call("HGET", KEYS[1], "status") ~= "open" then
+	return "not_open"
+end
+if redis.call("ZCARD", KEYS[2]) >= tonumber(redis.call("HGET", KEYS[1], "capacity")) then
+	return "full"
+end
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+redis.call("SET", KEYS[6], ARGV[1])
+index()
+publish({type = "member_joined", uid = tonumber(ARGV[2])})
+return "ok"
+`)
+
+// leaveScript removes ARGV[2] from the lobby, for the reason in ARGV[3]. It
+// returns "left", "host_changed" followed by the new host, or "closed" when
+// nobody is left.
+var leaveScript = redis.NewScript(lifecycleLua + `
+if not redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+	return {"not_member"}
+end
+redis.call("DEL", KEYS[6])
+if redis.call("ZCARD", KEYS[2]) == 1 then
+	close()
+	return {"closed"}
+end
+publish({type = "member_left", uid = tonumber(ARGV[2]), reason = ARGV[3]})
+remove_member(ARGV[2])
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+	return {"left"}
+end
+local host = redis.call("ZRANGE", KEYS[2], 0, 0)[1]
+redis.call("HSET", KEYS[1], "host", host)
+publish({type = "host_changed", host = tonumber(host)})
+return {"host_changed", host}
+`)
+
+// hostScript lets the host ARGV[2] hand the lobby over to ARGV[3]
+// (ARGV[4] == "transfer") or kick them out for good (ARGV[4] == "kick").
+var hostScript = redis.NewScript(lifecycleLua + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return "not_found"
+end
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+	return "not_host"
+end
+if ARGV[2] == ARGV[3] then
+	return "target_self"
+end
+if not redis.call("ZSCORE", KEYS[2], ARGV[3]) then
+	return "target_not_member"
+end
+if ARGV[4] == "transfer" then
+	redis.call("HSET", KEYS[1], "host", ARGV[3])
+	publish({type = "host_changed", host = tonumber(ARGV[3])})
+else
+	redis.call("DEL", KEYS[6])
+	redis.call("SADD", KEYS[4], ARGV[3])
+	publish({type = "member_kicked", uid = tonumber(ARGV[3])})
+	remove_member(ARGV[3])
+end
+return "ok"
+`)
+
+type Service struct {
+	rdb      *redis.Client
+	bans     *enforcement.Service
+	presence *presence.Service
+}
+
+func NewService(rdb *redis.Client, enforcementService *enforcement.Service, presenceService *presence.Service) *Service {
+	return &Service{
+		rdb:      rdb,
+		bans:     enforcementService,
+		presence: presenceService,
+	}
+}
+
+func (s *Service) Create(player betools.AuthInfo, req models.CreateLobbyRequest) (*models.Lobby, error) {
+	if req.Ranked {
+		if err := s.checkRanked(player); err != nil {
+			return nil, err
+		}
+	}
+
+	id := uuid.NewString()
+	ranked := "0"
+	if req.Ranked {
+		ranked = "1"
+	}
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = models.LobbyPublic
+	}
+	passHash := ""
+	if visibility == models.LobbyPassword {
+		var err error
+		if passHash, err = passhash.Hash(req.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	index, err := json.Marshal(indexKeys(req.Mode, ranked, req.Region, req.Map, req.Language))
+	if err != nil {
+		return nil, fmt.Errorf("json marshal: %w", err)
+	}
+
+	// a fresh code is drawn on the rare collision with a live lobby
+	for range 5 {
+		code, err := newInviteCode()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := createScript.Run(context.Background(), s.rdb,
+			append(scriptKeys(id, player.UserID), codeKey(code)),
+			id, player.UserID, req.Mode, ranked, req.Capacity, time.Now().UnixMilli(), env.C.LobbyMinPlayers,
+			env.C.LobbyReadyCheckSeconds*1000, env.C.LobbyCountdownSeconds*1000, env.C.LobbyLaunchTimeoutSeconds*1000,
+			visibility, code, passHash, req.Region, req.Map, req.Language, string(index),
+		).Text()
+		if err != nil {
+			return nil, fmt.Errorf("redis create lobby: %w", err)
+		}
+		if res == "code_taken" {
+			continue
+		}
+		if err, ok := scriptErrors[res]; ok {
+			return nil, err
+		}
+
+		s.setActivity(player.UserID, models.PresenceInLobby, id)
+
+		return s.Get(id)
+	}
+
+	return nil, fmt.Errorf("no free invite code")
+}
+
+func (s *Service) Join(player betools.AuthInfo, ref string, password string) (*models.Lobby, error) {
+	id, byCode, err := s.resolve(player.UserID, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	lobby, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if lobby.HasMember(player.UserID) {
+		return lobby, nil
+	}
+	if lobby.Visibility == models.LobbyUnlisted && !byCode {
+		return nil, ErrInviteRequired
+	}
+	if lobby.Ranked {
+		if err := s.checkRanked(player); err != nil {
+			return nil, err
+		}
+	}
+	if lobby.Visibility == models.LobbyPassword {
+		if err := s.checkPassword(player.UserID, id, password); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := joinScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, player.UserID),
+		id, player.UserID, time.Now().UnixMilli(),
+	).Text()
+	if err != nil {
+		return nil, fmt.Errorf("redis join lobby: %w", err)
+	}
+	if err, ok := scriptErrors[res]; ok {
+		return nil, err
+	}
+
+	s.setActivity(player.UserID, models.PresenceInLobby, id)
+
+	return s.Get(id)
+}
+
+func (s *Service) Leave(uid int, id string) error {
+	if err := s.leave(uid, id, "left"); err != nil {
+		return err
+	}
+
+	s.setActivity(uid, models.PresenceOnline, "")
+
+	return nil
+}
+
+func (s *Service) leave(uid int, id string, reason string) error {
+	res, err := leaveScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, uid),
+		id, uid, reason,
+	).StringSlice()
+	if err != nil {
+		return fmt.Errorf("redis leave lobby: %w", err)
+	}
+	if err, ok := scriptErrors[res[0]]; ok {
+		return err
+	}
+
+	switch res[0] {
+	case "host_changed":
+		slog.Info("lobby host changed", "lobby_id", id, "host", res[1])
+	case "closed":
+		slog.Info("lobby closed", "lobby_id", id)
+	}
+
+	return nil
+}
+
+func (s *Service) TransferHost(uid int, id string, target int) (*models.Lobby, error) {
+	if err := s.runHostScript(uid, id, target, "transfer"); err != nil {
+		return nil, err
+	}
+
+	return s.Get(id)
+}
+
+// Kick removes a member, who cannot join the lobby again.
+func (s *Service) Kick(uid int, id string, target int) (*models.Lobby, error) {
+	if err := s.runHostScript(uid, id, target, "kick"); err != nil {
+		return nil, err
+	}
+
+	s.setActivity(target, models.PresenceOnline, "")
+
+	return s.Get(id)
+}
+
+func (s *Service) runHostScript(uid int, id string, target int, action string) error {
+	res, err := hostScript.Run(context.Background(), s.rdb,
+		scriptKeys(id, target),
+		id, uid, target, action,
+	).Text()
+	if err != nil {
+		return fmt.Errorf("redis %s: %w", action, err)
+	}
+	if err, ok := scriptErrors[res]; ok {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Service) Subscribe(ctx context.Context, id string) *redis.PubSub {
+	return s.rdb.Subscribe(ctx, "lobby_events:"+id)
+}
+
+// RunDisconnectWatcher takes players out of their lobby when they go offline.
+func (s *Service) RunDisconnectWatcher() {
+	sub := s.presence.Subscribe(context.Background())
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		p := models.Presence{}
+		if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+			slog.Error("lobby disconnect watcher", "error", err)
+			continue
+		}
+		if p.Status != models.PresenceOffline {
+			continue
+		}
+
+		id, err := s.rdb.Get(context.Background(), playerLobbyKey(p.UserID)).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			slog.Error("lobby disconnect watcher", "uid", p.UserID, "error", err)
+			continue
+		}
+
+		if err := s.leave(p.UserID, id, "disconnected"); err != nil && !errors.Is(err, ErrNotMember) {
+			slog.Error("lobby disconnect watcher", "uid", p.UserID, "lobby_id", id, "error", err)
+		}
+	}
+}
+
+func (s *Service) Get(id string) (*models.Lobby, error) {
+	lobbies, err := s.getMany([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	if lobbies[0] == nil {
+		return nil, ErrNotFound
+	}
+
+	return lobbies[0], nil
+}
+
+// getMany leaves lobbies that do not exist nil.
+func (s *Service) getMany(ids []string) ([]*models.Lobby, error) {
+	fields := make([]*redis.MapStringStringCmd, len(ids))
+	members := make([]*redis.ZSliceCmd, len(ids))
+	ready := make([]*redis.StringSliceCmd, len(ids))
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			fields[i] = pipe.HGetAll(context.Background(), lobbyKey(id))
+			members[i] = pipe.ZRangeWithScores(context.Background(), lobbyKey(id)+":members", 0, -1)
+			ready[i] = pipe.SMembers(context.Background(), lobbyKey(id)+":ready")
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("redis tx: %w", err)
+	}
+
+	lobbies := make([]*models.Lobby, len(ids))
+	for i := range ids {
+		lobbies[i] = parseLobby(fields[i].Val(), members[i].Val(), ready[i].Val())
+	}
+
+	return lobbies, nil
+}
+
+func parseLobby(f map[string]string, members []redis.Z, ready []string) *models.Lobby {
+	if len(f) == 0 {
+		return nil
+	}
+
+	lobby := models.Lobby{
+		ID:         f["id"],
+		Mode:       f["mode"],
+		Ranked:     f["ranked"] == "1",
+		Status:     f["status"],
+		Visibility: f["visibility"],
+		Region:     f["region"],
+		Map:        f["map"],
+		Language:   f["language"],
+		InviteCode: f["code"],
+		Members:    []models.LobbyMember{},
+	}
+	lobby.Host, _ = strconv.Atoi(f["host"])
+	lobby.Capacity, _ = strconv.Atoi(f["capacity"])
+	if createdAt, err := strconv.ParseInt(f["created_at"], 10, 64); err == nil {
+		lobby.CreatedAt = time.UnixMilli(createdAt)
+	}
+	if deadline, err := strconv.ParseInt(f["deadline"], 10, 64); err == nil {
+		t := time.UnixMilli(deadline)
+		lobby.Deadline = &t
+	}
+
+	readySet := map[string]bool{}
+	for _, uid := range ready {
+		readySet[uid] = true
+	}
+
+	for _, member := range members {
+		uid, err := strconv.Atoi(member.Member.(string))
+		if err != nil {
+			continue
+		}
+		lobby.Members = append(lobby.Members, models.LobbyMember{
+			UserID:   uid,
+			JoinedAt: time.UnixMilli(int64(member.Score)),
+			Ready:    readySet[member.Member.(string)],
+		})
+	}
+
+	return &lobby
+}
+
+func (s *Service) checkRanked(player betools.AuthInfo) error {
+	if player.Guest {
+		return ErrGuestRanked
+	}
+	if env.C.EmailVerificationPolicy == env.EmailVerificationRanked && !player.EmailVerified {
+		return ErrEmailUnverified
+	}
+
+	sanction, err := s.bans.Active(player.UserID, models.SanctionRankedBan)
+	if err != nil {
+		return fmt.Errorf("check ranked ban: %w", err)
+	}
+	if sanction != nil {
+		return &models.BannedError{Sanction: *sanction}
+	}
+
+	return nil
+}
+
+// setActivity only logs failures, the lobby change is already done.
+func (s *Service) setActivity(uid int, status string, activity string) {
+	if err := s.presence.SetActivity(uid, status, activity); err != nil {
+		slog.Error("lobby set presence", "uid", uid, "error", err)
+	}
+}
+
+// scriptKeys returns the keys every lobby script is given, in the order
+// lifecycleLua expects them. uid is the player the script is about, if any.
+func scriptKeys(id string, uid int) []string {
+	return []string{
+		lobbyKey(id),
+		lobbyKey(id) + ":members",
+		lobbyKey(id) + ":ready",
+		lobbyKey(id) + ":kicked",
+		deadlinesKey,
+		playerLobbyKey(uid),
+	}
+}
+
+func lobbyKey(id string) string {
+	return "lobby:" + id
+}
+
+func playerLobbyKey(uid int) string {
+	return fmt.Sprintf("player_lobby:%d", uid)
+}
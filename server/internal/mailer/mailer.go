@@ -0,0 +1,111 @@
+// Package mailer sends transactional emails. The driver is picked with
+// MAILER_DRIVER: "log" prints who mails are sent to in the server log, "file"
+// writes them to MAILER_FILE_DIR, both meant for local development and tests
+// and refused in production, and "smtp" delivers them through MAILER_SMTP_*.
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"server/internal/env"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+func New() (Mailer, error) {
+	if env.C.IsProd && env.C.MailerDriver != "smtp" {
+		return nil, fmt.Errorf("mailer driver %q is not allowed in production", env.C.MailerDriver)
+	}
+
+	switch env.C.MailerDriver {
+	case "log":
+		return &LogMailer{}, nil
+	case "file":
+		if err := os.MkdirAll(env.C.MailerFileDir, 0o755); err != nil {
+			return nil, fmt.Errorf("mkdir: %w", err)
+		}
+		return &FileMailer{Dir: env.C.MailerFileDir}, nil
+	case "smtp":
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(env.C.MailerSMTPHost, env.C.MailerSMTPPort),
+			Host:     env.C.MailerSMTPHost,
+			Username: env.C.MailerSMTPUser,
+			Password: env.C.MailerSMTPPass,
+			From:     env.C.MailerFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer driver %q", env.C.MailerDriver)
+	}
+}
+
+// LogMailer leaves the body out, it holds live verification and reset tokens.
+type LogMailer struct{}
+
+func (m *LogMailer) Send(mail Mail) error {
+	slog.Info("mail", "to", mail.To, "subject", mail.Subject)
+	return nil
+}
+
+// FileMailer writes every mail to its own file so tests can pick them up.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"), uuid.NewString())
+
+	if err := os.WriteFile(filepath.Join(m.Dir, name), format("", mail), 0o644); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+
+	return nil
+}
+
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	if err := smtp.SendMail(m.Addr, auth, m.From, []string{mail.To}, format(m.From, mail)); err != nil {
+		return fmt.Errorf("smtp send: %w", err)
+	}
+
+	return nil
+}
+
+func format(from string, mail Mail) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n%s\r\n", mail.Body)
+	return []byte(b.String())
+}
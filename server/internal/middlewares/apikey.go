@@ -0,0 +1,60 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"server/pkg/betools"
+)
+
+// APIKeyVerifier resolves an API key to the service it was issued to,
+// returning nil for unknown or revoked keys. It is implemented by
+// apikey.Service, which cannot be imported here as its controller uses these
+// middlewares.
+type APIKeyVerifier interface {
+	VerifyAPIKey(key string) (*betools.ServiceInfo, error)
+}
+
+// APIKeyMiddleware authenticates service to service calls by their X-Api-Key
+// header. Handlers behind it read the caller with betools.GetServiceCtx, there
+// is no player in the auth context.
+func APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			slog.Error("api key middleware", "error", "missing api key")
+			betools.SendErrorResponse(w, http.StatusUnauthorized, "missing api key")
+			return
+		}
+
+		service, err := apiKeys.VerifyAPIKey(key)
+		if err != nil {
+			slog.Error("api key middleware", "error", err.Error())
+			betools.SendErrorResponse(w, http.StatusInternalServerError, "failed to check api key")
+			return
+		}
+		if service == nil {
+			slog.Error("api key middleware", "error", "api key invalid")
+			betools.SendErrorResponse(w, http.StatusUnauthorized, "api key invalid")
+			return
+		}
+
+		next.ServeHTTP(w, betools.SetContext(r, betools.CtxKeyService, *service))
+	})
+}
+
+// RequireScope only lets through services granted at least one of the given
+// scopes. It must run after APIKeyMiddleware.
+func RequireScope(scopes ...string) betools.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			service := betools.GetServiceCtx(r)
+			if !service.HasScope(scopes...) {
+				slog.Error("require scope", "key_id", service.KeyID, "scopes", service.Scopes, "required", scopes)
+				betools.SendErrorResponse(w, http.StatusForbidden, "insufficient scope")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
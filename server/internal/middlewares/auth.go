@@ -1,10 +1,12 @@
 package middlewares
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"server/internal/env"
+	"server/internal/jwtkeys"
+	"server/internal/models"
 	"server/pkg/betools"
 	"strconv"
 	"strings"
@@ -21,29 +23,84 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(bearerToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (any, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(env.C.JWTSecret), nil
-		})
-		if err != nil || !token.Valid {
+		claims, err := parseAccessToken(bearerToken)
+		if err != nil {
 			slog.Error("auth middleware", "error", err.Error())
 			betools.SendErrorResponse(w, http.StatusUnauthorized, "token invalid")
 			return
 		}
 
-		uid, err := strconv.Atoi(token.Claims.(*jwt.RegisteredClaims).Subject)
+		uid, err := strconv.Atoi(claims.Subject)
 		if err != nil {
 			slog.Error("auth middleware", "error", err.Error())
 			betools.SendErrorResponse(w, http.StatusUnauthorized, "token invalid")
 			return
 		}
 
-		next.ServeHTTP(w, betools.SetContext(r, betools.CtxKeyAuth, uid))
+		auth := betools.AuthInfo{
+			UserID:        uid,
+			SessionID:     claims.SessionID,
+			Roles:         claims.Roles,
+			EmailVerified: claims.EmailVerified,
+			Guest:         claims.Guest,
+			IssuedAt:      claims.IssuedAt.Time,
+		}
+
+		var banned *models.BannedError
+		if err := Recheck(auth); errors.Is(err, ErrTokenRevoked) {
+			slog.Error("auth middleware", "uid", uid, "error", err.Error())
+			betools.SendErrorResponse(w, http.StatusUnauthorized, "token revoked")
+			return
+		} else if errors.As(err, &banned) {
+			slog.Error("auth middleware", "uid", uid, "error", err.Error())
+			SendBanned(w, banned)
+			return
+		} else if err != nil {
+			slog.Error("auth middleware", "uid", uid, "error", err.Error())
+			betools.SendErrorResponse(w, http.StatusInternalServerError, "failed to check token")
+			return
+		}
+
+		next.ServeHTTP(w, betools.SetContext(r, betools.CtxKeyAuth, auth))
 	})
 }
 
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Recheck runs the revocation and ban checks of AuthMiddleware again, for
+// streams that outlive the request that opened them. It returns
+// ErrTokenRevoked or a *models.BannedError when the caller is no longer let
+// in.
+func Recheck(auth betools.AuthInfo) error {
+	revoked, err := isRevoked(auth.UserID, auth.SessionID, auth.IssuedAt)
+	if err != nil {
+		return fmt.Errorf("check revocation: %w", err)
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+
+	return bans.CheckBan(auth.UserID)
+}
+
+// parseAccessToken only accepts access tokens bound to a session, so a
+// refresh token cannot be used as a bearer token and every token accepted
+// goes through the session revocation check.
+func parseAccessToken(bearerToken string) (*models.AccessTokenClaims, error) {
+	claims := &models.AccessTokenClaims{}
+	token, err := jwt.ParseWithClaims(bearerToken, claims, jwtkeys.K.Keyfunc,
+		jwt.WithAudience(models.TokenAudienceAccess),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.SessionID == "" || claims.IssuedAt == nil {
+		return nil, fmt.Errorf("token invalid")
+	}
+
+	return claims, nil
+}
+
 func getBearer(header string) (string, bool) {
 	if !strings.HasPrefix(header, "Bearer ") {
 		return "", false
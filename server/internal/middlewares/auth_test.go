@@ -0,0 +1,68 @@
+package middlewares
+
+import (
+	"server/internal/env"
+	"server/internal/jwtkeys"
+	"server/internal/models"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func loadTestKeys(t *testing.T) {
+	t.Helper()
+
+	env.C = &env.Env{JWTKeysDir: t.TempDir()}
+	if err := jwtkeys.Load(); err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+}
+
+func signTestToken(t *testing.T, audience string, sessionID string) string {
+	t.Helper()
+
+	token, err := jwtkeys.K.Sign(models.AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "multiplayer-game-server",
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			Subject:   "42",
+		},
+		SessionID: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	return token
+}
+
+func TestParseAccessToken(t *testing.T) {
+	loadTestKeys(t)
+
+	tests := []struct {
+		name      string
+		audience  string
+		sessionID string
+		ok        bool
+	}{
+		{"access token", models.TokenAudienceAccess, "family", true},
+		{"refresh token", models.TokenAudienceRefresh, "family", false},
+		{"no audience", "", "family", false},
+		{"no session", models.TokenAudienceAccess, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := parseAccessToken(signTestToken(t, tt.audience, tt.sessionID))
+			if tt.ok && err != nil {
+				t.Fatalf("want accepted, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("want rejected, got claims for %s", claims.Subject)
+			}
+		})
+	}
+}
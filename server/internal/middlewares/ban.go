@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"net/http"
+	"server/internal/models"
+	"server/pkg/betools"
+)
+
+// BanChecker returns a *models.BannedError when the player is banned or
+// suspended. It is implemented by enforcement.Service.
+type BanChecker interface {
+	CheckBan(uid int) error
+}
+
+// SendBanned answers with the sanction keeping the player out, so clients can
+// tell them why and until when.
+func SendBanned(w http.ResponseWriter, err *models.BannedError) {
+	code, message := "account_banned", "account banned"
+	if err.Sanction.Kind == models.SanctionSuspension {
+		code, message = "account_suspended", "account suspended"
+	}
+
+	betools.SendErrorCodeResponse(w, http.StatusForbidden, code, message, models.BannedDetails{
+		Kind:   err.Sanction.Kind,
+		Reason: err.Sanction.Reason,
+		EndsAt: err.Sanction.EndsAt,
+	})
+}
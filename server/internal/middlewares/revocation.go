@@ -0,0 +1,108 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"server/internal/env"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	rdb     *redis.Client
+	apiKeys APIKeyVerifier
+	bans    BanChecker
+)
+
+// Init hands the middlewares the clients they need to consult shared state.
+// It must be called before the router starts serving.
+func Init(r *redis.Client, keys APIKeyVerifier, b BanChecker) {
+	rdb = r
+	apiKeys = keys
+	bans = b
+}
+
+type revocationEntry struct {
+	// validAfter is in Unix seconds; tokens issued up to it are revoked.
+	validAfter     int64
+	sessionRevoked bool
+	expiresAt      time.Time
+}
+
+// revocations caches revocation lookups in-process for
+// TokenRevocationCacheSeconds, so a revoked token may keep working on an
+// instance for at most that long.
+var revocations = struct {
+	sync.Mutex
+	entries map[string]revocationEntry
+}{
+	entries: map[string]revocationEntry{},
+}
+
+func isRevoked(uid int, sessionID string, issuedAt time.Time) (bool, error) {
+	entry, err := lookupRevocation(uid, sessionID)
+	if err != nil {
+		return false, err
+	}
+
+	if entry.sessionRevoked {
+		return true, nil
+	}
+
+	if issuedAt.Unix() <= entry.validAfter {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func lookupRevocation(uid int, sessionID string) (revocationEntry, error) {
+	cacheKey := fmt.Sprintf("%d:%s", uid, sessionID)
+
+	revocations.Lock()
+	entry, ok := revocations.entries[cacheKey]
+	revocations.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry, nil
+	}
+
+	pipe := rdb.Pipeline()
+	validAfterCmd := pipe.Get(context.Background(), fmt.Sprintf("access_valid_after:%d", uid))
+	var sessionRevokedCmd *redis.IntCmd
+	if sessionID != "" {
+		sessionRevokedCmd = pipe.Exists(context.Background(), "access_revoked_session:"+sessionID)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return revocationEntry{}, fmt.Errorf("redis pipeline: %w", err)
+	}
+
+	entry = revocationEntry{
+		expiresAt: time.Now().Add(time.Duration(env.C.TokenRevocationCacheSeconds) * time.Second),
+	}
+
+	if validAfter, err := validAfterCmd.Int64(); err == nil {
+		entry.validAfter = validAfter
+	} else if err != redis.Nil {
+		return revocationEntry{}, fmt.Errorf("redis get: %w", err)
+	}
+
+	if sessionRevokedCmd != nil {
+		entry.sessionRevoked = sessionRevokedCmd.Val() > 0
+	}
+
+	revocations.Lock()
+	if len(revocations.entries) >= 4096 {
+		now := time.Now()
+		for k, e := range revocations.entries {
+			if now.After(e.expiresAt) {
+				delete(revocations.entries, k)
+			}
+		}
+	}
+	revocations.entries[cacheKey] = entry
+	revocations.Unlock()
+
+	return entry, nil
+}
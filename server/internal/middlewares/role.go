@@ -0,0 +1,24 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"server/pkg/betools"
+)
+
+// RequireRole only lets through callers having at least one of the given
+// roles. It reads the auth context, so it must run after AuthMiddleware.
+func RequireRole(roles ...string) betools.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := betools.GetAuthCtx(r)
+			if !auth.HasRole(roles...) {
+				slog.Error("require role", "uid", auth.UserID, "roles", auth.Roles, "required", roles)
+				betools.SendErrorResponse(w, http.StatusForbidden, "insufficient role")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
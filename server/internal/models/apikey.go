@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// API key scopes, granting dedicated game servers access to the service
+// endpoints.
+const (
+	ScopeMatchReport   = "match:report"
+	ScopeLoadoutRead   = "loadout:read"
+	ScopePresenceWrite = "presence:write"
+	ScopeLobbyWrite    = "lobby:write"
+)
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,min=2,max=64"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=match:report loadout:read presence:write lobby:write"`
+}
+
+type CreateAPIKeyResponse struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Key is only ever returned here, the server keeps just its hash.
+	Key string `json:"key"`
+}
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  *int       `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
 
 type RegisterRequest struct {
 	FirstName string `json:"first_name" validate:"required,min=2,max=32"`
@@ -12,23 +16,58 @@ type RegisterRequest struct {
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required,min=8,max=128"`
+	Device   string `json:"device" validate:"omitempty,max=64"`
+}
+
+type ClientInfo struct {
+	IP        string
+	UserAgent string
 }
 
 type LoginResult struct {
-	AccessToken  string
-	RefreshToken string
-	UserID       int
-	ExpiresIn    time.Time
+	AccessToken      string
+	RefreshToken     string
+	UserID           int
+	ExpiresIn        time.Time
+	RefreshExpiresIn time.Time
+	// MFAToken is set instead of the tokens above when the account has 2FA
+	// enabled and the login must be completed with a code.
+	MFAToken string
 }
 
 type LoginResponse struct {
-	AccessToken string    `json:"access_token"`
-	TokenType   string    `json:"token_type"`
-	ExpiresIn   time.Time `json:"expires_in"`
+	AccessToken string    `json:"access_token,omitempty"`
+	TokenType   string    `json:"token_type,omitempty"`
+	ExpiresIn   time.Time `json:"expires_in,omitzero"`
+	MFARequired bool      `json:"mfa_required,omitempty"`
+	MFAToken    string    `json:"mfa_token,omitempty"`
+}
+
+const (
+	RolePlayer     = "player"
+	RoleModerator  = "moderator"
+	RoleAdmin      = "admin"
+	RoleGameServer = "game-server"
+)
+
+// Token audiences. Access and refresh tokens are signed with the same keys,
+// the audience keeps one from being accepted in place of the other.
+const (
+	TokenAudienceAccess  = "access"
+	TokenAudienceRefresh = "refresh"
+)
+
+type AccessTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID     string   `json:"sid,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	EmailVerified bool     `json:"email_verified"`
+	Guest         bool     `json:"guest,omitempty"`
 }
 
 type RefreshTokenCacheVal struct {
 	UserID    int
+	FamilyID  string
 	ExpiresIn time.Time
 }
 
@@ -41,3 +80,74 @@ type Account struct {
 	LastName  string `json:"last_name"`
 	Email     string `json:"email"`
 }
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+type SetRolesRequest struct {
+	Roles []string `json:"roles" validate:"required,min=1,dive,oneof=player moderator admin game-server"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=128"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required,max=128"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=128"`
+}
+
+type LoginMFARequest struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode string `json:"recovery_code" validate:"required_without=Code"`
+	Device       string `json:"device" validate:"omitempty,max=64"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TOTPConfirmRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type TOTPConfirmResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TOTPDisableRequest struct {
+	// Password is left out by accounts without one.
+	Password string `json:"password" validate:"max=128"`
+	Code     string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type GuestLoginRequest struct {
+	DeviceID string `json:"device_id" validate:"required,min=32,max=128"`
+	Device   string `json:"device" validate:"omitempty,max=64"`
+}
+
+type OAuthStartResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
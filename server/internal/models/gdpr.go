@@ -0,0 +1,73 @@
+package models
+
+import "time"
+
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+type DataExport struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"uid"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DataExportArchive is everything held about a player. Each store of player
+// data adds its section here.
+type DataExportArchive struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Account     ExportedAccount    `json:"account"`
+	Profile     *ExportedProfile   `json:"profile"`
+	Identities  []ExportedIdentity `json:"identities"`
+	Sanctions   []Sanction         `json:"sanctions"`
+	Sessions    []Session          `json:"sessions"`
+	Storage     []StorageEntry     `json:"storage"`
+	Settings    *PlayerSettings    `json:"settings"`
+}
+
+type ExportedAccount struct {
+	ID                   int        `json:"id"`
+	FirstName            *string    `json:"first_name"`
+	LastName             *string    `json:"last_name"`
+	Email                *string    `json:"email"`
+	EmailVerifiedAt      *time.Time `json:"email_verified_at"`
+	Roles                []string   `json:"roles"`
+	IsGuest              bool       `json:"is_guest"`
+	TOTPEnabledAt        *time.Time `json:"totp_enabled_at"`
+	CreatedAt            time.Time  `json:"created_at"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for"`
+}
+
+type ExportedProfile struct {
+	Handle          *string    `json:"handle"`
+	DisplayName     string     `json:"display_name"`
+	AvatarURL       string     `json:"avatar_url"`
+	Level           int        `json:"level"`
+	Rank            string     `json:"rank"`
+	Visibility      string     `json:"visibility"`
+	ShowRank        bool       `json:"show_rank"`
+	HandleChangedAt *time.Time `json:"handle_changed_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type ExportedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     *string   `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeleteAccountRequest confirms the deletion with the password and a 2FA
+// code, on accounts having them.
+type DeleteAccountRequest struct {
+	Password string `json:"password" validate:"max=128"`
+	Code     string `json:"code" validate:"omitempty,len=6,numeric"`
+}
+
+type AccountDeletionResponse struct {
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
@@ -0,0 +1,144 @@
+package models
+
+import "time"
+
+// Lobby statuses. A lobby is open to joins until its host starts a ready
+// check; once every member is ready a countdown runs, then it is launching
+// until a game server reports the match in game, and closed when the match
+// ends. Ready checks, countdowns and launches time out on their own.
+const (
+	LobbyOpen       = "open"
+	LobbyReadyCheck = "ready_check"
+	LobbyCountdown  = "countdown"
+	LobbyLaunching  = "launching"
+	LobbyInGame     = "in_game"
+	LobbyClosed     = "closed"
+)
+
+// Lobby visibilities. Public lobbies can be joined by ID, unlisted ones only
+// with their invite code, and password lobbies by either with the password.
+const (
+	LobbyPublic   = "public"
+	LobbyUnlisted = "unlisted"
+	LobbyPassword = "password"
+)
+
+type Lobby struct {
+	ID         string `json:"id"`
+	Host       int    `json:"host"`
+	Mode       string `json:"mode"`
+	Ranked     bool   `json:"ranked"`
+	Capacity   int    `json:"capacity"`
+	Status     string `json:"status"`
+	Visibility string `json:"visibility"`
+	Region     string `json:"region,omitempty"`
+	Map        string `json:"map,omitempty"`
+	Language   string `json:"language,omitempty"`
+	// InviteCode is only shown to the members.
+	InviteCode string `json:"invite_code,omitempty"`
+	// Deadline is when the current status moves on by itself, if it does.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Members are in the order they joined, the host first.
+	Members   []LobbyMember `json:"members"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// HasMember reports whether the player is in the lobby.
+func (l Lobby) HasMember(uid int) bool {
+	for _, member := range l.Members {
+		if member.UserID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+type LobbyMember struct {
+	UserID   int       `json:"uid"`
+	JoinedAt time.Time `json:"joined_at"`
+	Ready    bool      `json:"ready"`
+}
+
+type CreateLobbyRequest struct {
+	Mode     string `json:"mode" validate:"required,max=32"`
+	Ranked   bool   `json:"ranked"`
+	Capacity int    `json:"capacity" validate:"required,min=2,max=16"`
+	// Visibility defaults to public.
+	Visibility string `json:"visibility" validate:"omitempty,oneof=public unlisted password"`
+	Password   string `json:"password" validate:"required_if=Visibility password,excluded_unless=Visibility password,max=64"`
+	Region     string `json:"region" validate:"max=16"`
+	Map        string `json:"map" validate:"max=32"`
+	Language   string `json:"language" validate:"omitempty,alpha,min=2,max=3"`
+}
+
+// ListLobbiesRequest filters and sorts the lobby browser, from the query
+// string.
+type ListLobbiesRequest struct {
+	Mode     string `json:"mode" validate:"max=32"`
+	Region   string `json:"region" validate:"max=16"`
+	Map      string `json:"map" validate:"max=32"`
+	Language string `json:"language" validate:"max=3"`
+	Ranked   *bool  `json:"ranked"`
+	// OpenSlots is the least number of free slots. Full lobbies are never
+	// listed.
+	OpenSlots int    `json:"open_slots" validate:"min=1,max=16"`
+	Sort      string `json:"sort" validate:"oneof=newest oldest fullest emptiest"`
+	Page      int    `json:"page" validate:"min=1"`
+	Limit     int    `json:"limit" validate:"min=1,max=100"`
+}
+
+type JoinLobbyRequest struct {
+	Password string `json:"password" validate:"max=64"`
+}
+
+// Lobby event types, published to the members as things happen.
+const (
+	LobbyEventMemberJoined  = "member_joined"
+	LobbyEventMemberLeft    = "member_left"
+	LobbyEventMemberKicked  = "member_kicked"
+	LobbyEventHostChanged   = "host_changed"
+	LobbyEventReadyChanged  = "ready_changed"
+	LobbyEventStatusChanged = "status_changed"
+	LobbyEventClosed        = "lobby_closed"
+)
+
+type LobbyEvent struct {
+	Type    string `json:"type"`
+	LobbyID string `json:"lobby_id"`
+	UserID  int    `json:"uid,omitempty"`
+	Host    int    `json:"host,omitempty"`
+	// Reason is why a member left: left or disconnected.
+	Reason string `json:"reason,omitempty"`
+	Ready  *bool  `json:"ready,omitempty"`
+	Status string `json:"status,omitempty"`
+	// DeadlineMs is when the new status moves on by itself, in Unix
+	// milliseconds.
+	DeadlineMs int64 `json:"deadline_ms,omitempty"`
+}
+
+// LobbyMemberRequest names the member a host transfers the lobby to or kicks.
+type LobbyMemberRequest struct {
+	UserID int `json:"uid" validate:"required"`
+}
+
+type SetReadyRequest struct {
+	Ready bool `json:"ready"`
+}
+
+// LobbyLaunch is added to the lobby_launches stream, as its launch field,
+// when a lobby's countdown ends, for match allocators to find it a server.
+type LobbyLaunch struct {
+	LobbyID  string `json:"lobby_id"`
+	Mode     string `json:"mode"`
+	Ranked   bool   `json:"ranked"`
+	Capacity int    `json:"capacity"`
+	Region   string `json:"region"`
+	Map      string `json:"map"`
+	Language string `json:"language"`
+	Members  []int  `json:"members"`
+}
+
+// ReportLobbyStatusRequest is sent by the game server hosting the match.
+type ReportLobbyStatusRequest struct {
+	Status string `json:"status" validate:"required,oneof=in_game closed"`
+}
@@ -1,6 +1,53 @@
 package models
 
+import "time"
+
+// UpdatePlayerRequest only changes the fields present in the body.
 type UpdatePlayerRequest struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	FirstName *string `json:"first_name" validate:"omitempty,min=2,max=32"`
+	LastName  *string `json:"last_name" validate:"omitempty,min=2,max=32"`
+}
+
+// Profile is what other players see of an account, see PrivacySettings for
+// what gets hidden.
+type Profile struct {
+	UserID      int       `json:"uid"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Level       int       `json:"level,omitempty"`
+	Rank        string    `json:"rank,omitempty"`
+	JoinedAt    time.Time `json:"joined_at,omitzero"`
+	Private     bool      `json:"private,omitempty"`
+}
+
+const (
+	ProfilePublic  = "public"
+	ProfilePrivate = "private"
+)
+
+type PrivacySettings struct {
+	// Visibility private hides everything but the handle, display name and
+	// avatar.
+	Visibility string `json:"visibility"`
+	ShowRank   bool   `json:"show_rank"`
+}
+
+// PlayerMe is the full view of the caller's own account.
+type PlayerMe struct {
+	Account
+	Profile Profile         `json:"profile"`
+	Privacy PrivacySettings `json:"privacy"`
+}
+
+// UpdateProfileRequest only changes the fields present in the body.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"display_name" validate:"omitempty,min=2,max=32"`
+	AvatarURL   *string `json:"avatar_url" validate:"omitempty,url,max=512"`
+	Visibility  *string `json:"visibility" validate:"omitempty,oneof=public private"`
+	ShowRank    *bool   `json:"show_rank"`
+}
+
+type ChangeHandleRequest struct {
+	Handle string `json:"handle" validate:"required,min=3,max=20"`
 }
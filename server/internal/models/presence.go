@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Presence statuses. Players go online with their first heartbeat, lobbies and
+// match servers move them to in_lobby and in_match, and they fall back to
+// offline when heartbeats stop.
+const (
+	PresenceOffline = "offline"
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceInLobby = "in_lobby"
+	PresenceInMatch = "in_match"
+)
+
+type Presence struct {
+	UserID int    `json:"uid"`
+	Status string `json:"status"`
+	// Activity is the lobby or match the player is in.
+	Activity  string    `json:"activity,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+}
+
+type HeartbeatRequest struct {
+	Status string `json:"status" validate:"required,oneof=online away"`
+}
+
+type SetPresenceRequest struct {
+	Status   string `json:"status" validate:"required,oneof=online in_lobby in_match"`
+	Activity string `json:"activity" validate:"max=64"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sanction kinds. Bans and suspensions keep the player out entirely, ranked
+// bans and mutes only restrict what they can do once logged in.
+const (
+	SanctionBan        = "ban"
+	SanctionSuspension = "suspension"
+	SanctionRankedBan  = "ranked_ban"
+	SanctionMute       = "mute"
+)
+
+type Sanction struct {
+	ID         int        `json:"id"`
+	AccountID  int        `json:"account_id"`
+	Kind       string     `json:"kind"`
+	Reason     string     `json:"reason"`
+	IssuedBy   *int       `json:"issued_by"`
+	StartsAt   time.Time  `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"` // nil when permanent
+	AppealNote string     `json:"appeal_note"`
+	LiftedAt   *time.Time `json:"lifted_at"`
+	LiftedBy   *int       `json:"lifted_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ActiveAt reports whether the sanction is in force at t.
+func (s Sanction) ActiveAt(t time.Time) bool {
+	return s.LiftedAt == nil && !t.Before(s.StartsAt) && (s.EndsAt == nil || t.Before(*s.EndsAt))
+}
+
+type IssueSanctionRequest struct {
+	Kind       string     `json:"kind" validate:"required,oneof=ban suspension ranked_ban mute"`
+	Reason     string     `json:"reason" validate:"required,max=500"`
+	StartsAt   *time.Time `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	AppealNote string     `json:"appeal_note" validate:"max=1000"`
+}
+
+type UpdateAppealNoteRequest struct {
+	AppealNote string `json:"appeal_note" validate:"max=1000"`
+}
+
+// BannedError is returned when an active ban or suspension keeps the player
+// from logging in or using their tokens.
+type BannedError struct {
+	Sanction Sanction
+}
+
+func (e *BannedError) Error() string {
+	if e.Sanction.EndsAt == nil {
+		return fmt.Sprintf("account %s, permanent", e.Sanction.Kind)
+	}
+	return fmt.Sprintf("account %s until %s", e.Sanction.Kind, e.Sanction.EndsAt.Format(time.RFC3339))
+}
+
+type BannedDetails struct {
+	Kind   string     `json:"kind"`
+	Reason string     `json:"reason"`
+	EndsAt *time.Time `json:"ends_at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type StorageEntry struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Version   int             `json:"version"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type PutStorageRequest struct {
+	Value json.RawMessage `json:"value" validate:"required"`
+	// Version is the version being replaced, 0 to create the entry.
+	Version int `json:"version" validate:"min=0"`
+}
+
+// PlayerSettings is the settings document (keybinds, graphics...) synced
+// across the player's devices. Version 0 means it was never saved.
+type PlayerSettings struct {
+	Settings  json.RawMessage `json:"settings"`
+	Version   int             `json:"version"`
+	UpdatedAt time.Time       `json:"updated_at,omitzero"`
+}
+
+type PutSettingsRequest struct {
+	Settings json.RawMessage `json:"settings" validate:"required"`
+	// Version is the version being replaced, 0 for the first save.
+	Version int `json:"version" validate:"min=0"`
+}
+
+type VersionConflictDetails struct {
+	CurrentVersion int `json:"current_version"`
+}
@@ -0,0 +1,19 @@
+// Package passhash hashes the passwords of accounts and lobbies alike.
+package passhash
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const cost = 12
+
+func Hash(password string) (string, error) {
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt generate: %w", err)
+	}
+
+	return string(passHash), nil
+}
@@ -1,7 +1,9 @@
 package player
 
 import (
+	"errors"
 	"log/slog"
+	"math"
 	"net/http"
 	"server/internal/middlewares"
 	"server/internal/models"
@@ -32,6 +34,11 @@ func (c *Controller) GetRoutes() []betools.Route {
 				Pattern:     "/player/me",
 				HandlerFunc: c.handleGetMe,
 			},
+			{
+				Method:      "GET",
+				Pattern:     "/player/search",
+				HandlerFunc: c.handleSearch,
+			},
 			{
 				Method:      "GET",
 				Pattern:     "/player/{uid}",
@@ -45,14 +52,30 @@ func (c *Controller) GetRoutes() []betools.Route {
 					betools.BodyParser[models.UpdatePlayerRequest](),
 				},
 			},
+			{
+				Method:      "PUT",
+				Pattern:     "/player/me/handle",
+				HandlerFunc: c.handleChangeHandle,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.ChangeHandleRequest](),
+				},
+			},
+			{
+				Method:      "PUT",
+				Pattern:     "/player/me/profile",
+				HandlerFunc: c.handleUpdateProfile,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.UpdateProfileRequest](),
+				},
+			},
 		},
 	)
 }
 
 func (c *Controller) handleGetMe(w http.ResponseWriter, r *http.Request) {
-	uid := betools.GetAuthCtx(r)
+	uid := betools.GetAuthCtx(r).UserID
 
-	res, err := c.svc.GetInfo(uid)
+	res, err := c.svc.GetMe(uid)
 	if err != nil {
 		slog.Error("get player info", "uid", uid, "error", err)
 		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get player info")
@@ -70,8 +93,12 @@ func (c *Controller) handleGetInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := c.svc.GetInfo(uid)
-	if err != nil {
+	res, err := c.svc.GetPublicProfile(uid)
+	if errors.Is(err, ErrNotFound) {
+		slog.Error("get player info", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "player not found")
+		return
+	} else if err != nil {
 		slog.Error("get player info", "uid", uid, "error", err)
 		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get player info")
 		return
@@ -82,13 +109,86 @@ func (c *Controller) handleGetInfo(w http.ResponseWriter, r *http.Request) {
 
 func (c *Controller) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
 	req := betools.GetBodyCtx[models.UpdatePlayerRequest](r)
-	uid := betools.GetAuthCtx(r)
+	uid := betools.GetAuthCtx(r).UserID
 
-	if err := c.svc.UpdateInfo(uid, req); err != nil {
+	res, err := c.svc.UpdateInfo(uid, req)
+	if err != nil {
 		slog.Error("update player info", "uid", uid, "error", err)
 		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update player info")
 		return
 	}
 
-	betools.SendOKResponse(w)
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.UpdateProfileRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.UpdateProfile(uid, req)
+	if err != nil {
+		slog.Error("update profile", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update profile")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleChangeHandle(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.ChangeHandleRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.ChangeHandle(uid, req.Handle)
+	var cooldown *HandleCooldownError
+	if errors.As(err, &cooldown) {
+		slog.Error("change handle", "uid", uid, "handle", req.Handle, "error", err)
+		retryAfter := int(math.Ceil(cooldown.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		betools.SendErrorCodeResponse(w, http.StatusTooManyRequests, "handle_cooldown", "handle changed too recently", map[string]int{
+			"retry_after_seconds": retryAfter,
+		})
+		return
+	} else if errors.Is(err, ErrInvalidHandle) {
+		slog.Error("change handle", "uid", uid, "handle", req.Handle, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, ErrHandleTaken) {
+		slog.Error("change handle", "uid", uid, "handle", req.Handle, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		slog.Error("change handle", "uid", uid, "handle", req.Handle, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to change handle")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+
+	limit := 10
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > 50 {
+			slog.Error("search players", "limit", param, "error", "invalid limit")
+			betools.SendErrorResponse(w, http.StatusBadRequest, "limit must be between 1 and 50")
+			return
+		}
+	}
+
+	res, err := c.svc.SearchHandles(query, limit)
+	if errors.Is(err, ErrInvalidHandle) {
+		slog.Error("search players", "q", query, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "invalid search query")
+		return
+	} else if err != nil {
+		slog.Error("search players", "q", query, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to search players")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
 }
@@ -0,0 +1,198 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"server/internal/env"
+	"server/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+// Handles are unique ignoring case, with no discriminator. They are indexed
+// for typeahead in the handle_index sorted set, all members at score 0 as
+// <lowercase handle>:<uid> so ZRANGEBYLEX finds them by prefix. Postgres
+// stays the source of truth, the index is rebuilt from it on startup.
+const handleIndexKey = "handle_index"
+
+var (
+	ErrInvalidHandle = errors.New("handles are 3 to 20 letters, digits or underscores")
+	ErrHandleTaken   = errors.New("handle already taken")
+)
+
+var (
+	handlePattern       = regexp.MustCompile(`^[A-Za-z0-9_]{3,20}$`)
+	handlePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,20}$`)
+)
+
+// HandleCooldownError is returned when the handle was changed too recently.
+type HandleCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *HandleCooldownError) Error() string {
+	return fmt.Sprintf("handle changed recently, retry after %s", e.RetryAfter)
+}
+
+// ChangeHandle sets the player's handle. Picking the first one is free, after
+// that it can change once every HandleChangeCooldownSeconds.
+func (s *Service) ChangeHandle(uid int, handle string) (*models.PlayerMe, error) {
+	if !handlePattern.MatchString(handle) {
+		return nil, ErrInvalidHandle
+	}
+
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("postgres begin: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var oldHandle *string
+	var changedAt *time.Time
+	err = tx.QueryRow(context.Background(),
+		"SELECT handle, handle_changed_at FROM player_profiles WHERE account_id = $1 FOR UPDATE",
+		uid,
+	).Scan(&oldHandle, &changedAt)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	cooldown := time.Duration(env.C.HandleChangeCooldownSeconds) * time.Second
+	if oldHandle != nil && changedAt != nil && time.Since(*changedAt) < cooldown {
+		return nil, &HandleCooldownError{RetryAfter: time.Until(changedAt.Add(cooldown))}
+	}
+
+	if _, err := tx.Exec(context.Background(),
+		`INSERT INTO player_profiles (account_id, handle, handle_changed_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (account_id) DO UPDATE SET handle = $2, handle_changed_at = NOW(), updated_at = NOW()`,
+		uid, handle,
+	); err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
+			return nil, ErrHandleTaken
+		}
+		return nil, fmt.Errorf("postgres upsert: %w", err)
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return nil, fmt.Errorf("postgres commit: %w", err)
+	}
+
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		if oldHandle != nil {
+			pipe.ZRem(context.Background(), handleIndexKey, handleMember(*oldHandle, uid))
+		}
+		pipe.ZAdd(context.Background(), handleIndexKey, redis.Z{Member: handleMember(handle, uid)})
+		pipe.Del(context.Background(), fmt.Sprintf("profile:%d", uid))
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("redis tx: %w", err)
+	}
+
+	return s.GetMe(uid)
+}
+
+// SearchHandles returns the public profiles of up to limit players whose
+// handle starts with query, ignoring case.
+func (s *Service) SearchHandles(query string, limit int) ([]models.Profile, error) {
+	if !handlePrefixPattern.MatchString(query) {
+		return nil, ErrInvalidHandle
+	}
+	query = strings.ToLower(query)
+
+	members, err := s.rdb.ZRangeByLex(context.Background(), handleIndexKey, &redis.ZRangeBy{
+		Min:   "[" + query,
+		Max:   "[" + query + "\xff",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis zrangebylex: %w", err)
+	}
+
+	uids := []int{}
+	for _, member := range members {
+		sep := strings.LastIndexByte(member, ':')
+		if sep < 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(member[sep+1:])
+		if err != nil {
+			continue
+		}
+		uids = append(uids, uid)
+	}
+
+	stored, err := s.getProfiles(uids)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []models.Profile{}
+	for _, uid := range uids {
+		// players deleted since they were indexed are not found
+		if profile, ok := stored[uid]; ok {
+			profiles = append(profiles, profile.public())
+		}
+	}
+
+	return profiles, nil
+}
+
+// RebuildHandleIndex rebuilds handle_index from Postgres, swapping it in at
+// once so searches never see it half built.
+func (s *Service) RebuildHandleIndex() error {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT account_id, handle FROM player_profiles WHERE handle IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	members := []redis.Z{}
+	for rows.Next() {
+		var uid int
+		var handle string
+		if err := rows.Scan(&uid, &handle); err != nil {
+			rows.Close()
+			return fmt.Errorf("postgres scan: %w", err)
+		}
+		members = append(members, redis.Z{Member: handleMember(handle, uid)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("postgres rows: %w", err)
+	}
+
+	if len(members) == 0 {
+		if err := s.rdb.Del(context.Background(), handleIndexKey).Err(); err != nil {
+			return fmt.Errorf("redis del: %w", err)
+		}
+		return nil
+	}
+
+	tmpKey := handleIndexKey + ":rebuild"
+	pipe := s.rdb.TxPipeline()
+	pipe.Del(context.Background(), tmpKey)
+	for i := 0; i < len(members); i += 1000 {
+		pipe.ZAdd(context.Background(), tmpKey, members[i:min(i+1000, len(members))]...)
+	}
+	pipe.Rename(context.Background(), tmpKey, handleIndexKey)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("redis tx: %w", err)
+	}
+
+	slog.Info("handle index rebuilt", "handles", len(members))
+
+	return nil
+}
+
+func handleMember(handle string, uid int) string {
+	return fmt.Sprintf("%s:%d", strings.ToLower(handle), uid)
+}
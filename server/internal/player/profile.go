@@ -0,0 +1,218 @@
+package player
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"server/internal/env"
+	"server/internal/models"
+	"time"
+
+	"github.com/georgysavva/scany/v2/pgxscan"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNotFound = errors.New("player not found")
+
+// storedProfile is the unfiltered profile cached at profile:<uid>. Accounts
+// without a player_profiles row yet get the column defaults, and the display
+// name falls back to the first name until the player picks one.
+type storedProfile struct {
+	Profile models.Profile
+	Privacy models.PrivacySettings
+}
+
+type profileRow struct {
+	UserID      int
+	Handle      string
+	DisplayName string
+	AvatarURL   string
+	Level       int
+	Rank        string
+	JoinedAt    time.Time
+	Visibility  string
+	ShowRank    bool
+}
+
+// GetMe returns the caller's own account with the unfiltered profile and
+// privacy settings.
+func (s *Service) GetMe(uid int) (*models.PlayerMe, error) {
+	account, err := s.GetInfo(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := s.getProfile(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.PlayerMe{
+		Account: *account,
+		Profile: profile.Profile,
+		Privacy: profile.Privacy,
+	}, nil
+}
+
+// GetPublicProfile returns the profile as other players may see it.
+func (s *Service) GetPublicProfile(uid int) (*models.Profile, error) {
+	stored, err := s.getProfile(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := stored.public()
+	return &profile, nil
+}
+
+// public filters the profile down to what the privacy settings let others
+// see.
+func (p storedProfile) public() models.Profile {
+	profile := p.Profile
+	if p.Privacy.Visibility == models.ProfilePrivate {
+		return models.Profile{
+			UserID:      profile.UserID,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+			Private:     true,
+		}
+	}
+	if !p.Privacy.ShowRank {
+		profile.Rank = ""
+	}
+
+	return profile
+}
+
+func (s *Service) UpdateProfile(uid int, req models.UpdateProfileRequest) (*models.PlayerMe, error) {
+	if _, err := s.db.Exec(context.Background(),
+		`INSERT INTO player_profiles (account_id, display_name, avatar_url, visibility, show_rank)
+		VALUES ($1, COALESCE($2, ''), COALESCE($3, ''), COALESCE($4, 'public'), COALESCE($5, TRUE))
+		ON CONFLICT (account_id) DO UPDATE SET
+			display_name = COALESCE($2, player_profiles.display_name),
+			avatar_url = COALESCE($3, player_profiles.avatar_url),
+			visibility = COALESCE($4, player_profiles.visibility),
+			show_rank = COALESCE($5, player_profiles.show_rank),
+			updated_at = NOW()`,
+		uid, req.DisplayName, req.AvatarURL, req.Visibility, req.ShowRank,
+	); err != nil {
+		return nil, fmt.Errorf("postgres upsert: %w", err)
+	}
+
+	if err := s.rdb.Del(context.Background(), fmt.Sprintf("profile:%d", uid)).Err(); err != nil {
+		return nil, fmt.Errorf("redis del: %w", err)
+	}
+
+	return s.GetMe(uid)
+}
+
+func (s *Service) getProfile(uid int) (*storedProfile, error) {
+	profiles, err := s.getProfiles([]int{uid})
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := profiles[uid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return profile, nil
+}
+
+// getProfiles returns the profiles of the players found, in one cache read
+// and at most one query for the ones not cached.
+func (s *Service) getProfiles(uids []int) (map[int]*storedProfile, error) {
+	profiles := map[int]*storedProfile{}
+	if len(uids) == 0 {
+		return profiles, nil
+	}
+
+	keys := make([]string, len(uids))
+	for i, uid := range uids {
+		keys[i] = fmt.Sprintf("profile:%d", uid)
+	}
+
+	cached, err := s.rdb.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis mget: %w", err)
+	}
+
+	missing := []int{}
+	for i, uid := range uids {
+		profileJson, ok := cached[i].(string)
+		if !ok {
+			missing = append(missing, uid)
+			continue
+		}
+
+		profile := storedProfile{}
+		if err := json.Unmarshal([]byte(profileJson), &profile); err != nil {
+			return nil, fmt.Errorf("json unmarshal: %w", err)
+		}
+		profiles[uid] = &profile
+	}
+	if len(missing) == 0 {
+		return profiles, nil
+	}
+
+	rows := []profileRow{}
+	if err := pgxscan.Select(context.Background(), s.db, &rows,
+		`SELECT a.id AS user_id, COALESCE(p.handle, '') AS handle, COALESCE(NULLIF(p.display_name, ''), LEFT(COALESCE(a.first_name, ''), 32)) AS display_name,
+			COALESCE(p.avatar_url, '') AS avatar_url, COALESCE(p.level, 1) AS level, COALESCE(p.rank, 'unranked') AS rank,
+			a.created_at AS joined_at, COALESCE(p.visibility, 'public') AS visibility, COALESCE(p.show_rank, TRUE) AS show_rank
+		FROM accounts a LEFT JOIN player_profiles p ON p.account_id = a.id WHERE a.id = ANY($1) AND a.deleted_at IS NULL`,
+		missing,
+	); err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	pipe := s.rdb.Pipeline()
+	for _, row := range rows {
+		profile := storedProfile{
+			Profile: models.Profile{
+				UserID:      row.UserID,
+				Handle:      row.Handle,
+				DisplayName: row.DisplayName,
+				AvatarURL:   row.AvatarURL,
+				Level:       row.Level,
+				Rank:        row.Rank,
+				JoinedAt:    row.JoinedAt,
+			},
+			Privacy: models.PrivacySettings{
+				Visibility: row.Visibility,
+				ShowRank:   row.ShowRank,
+			},
+		}
+		profiles[row.UserID] = &profile
+
+		profileJson, err := json.Marshal(profile)
+		if err != nil {
+			return nil, fmt.Errorf("json marshal: %w", err)
+		}
+		pipe.Set(context.Background(), fmt.Sprintf("profile:%d", row.UserID), string(profileJson), time.Duration(env.C.ProfileCacheSeconds)*time.Second)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("redis pipeline: %w", err)
+	}
+
+	return profiles, nil
+}
+
+// Forget drops everything cached about a deleted player, including their
+// handle from the search index.
+func (s *Service) Forget(uid int, handle string) error {
+	if _, err := s.rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		if handle != "" {
+			pipe.ZRem(context.Background(), handleIndexKey, handleMember(handle, uid))
+		}
+		pipe.Del(context.Background(), fmt.Sprintf("account:%d", uid), fmt.Sprintf("profile:%d", uid))
+		return nil
+	}); err != nil {
+		return fmt.Errorf("redis tx: %w", err)
+	}
+
+	return nil
+}
@@ -9,16 +9,16 @@ import (
 	"time"
 
 	"github.com/georgysavva/scany/v2/pgxscan"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
 type Service struct {
 	rdb *redis.Client
-	db  *pgx.Conn
+	db  *pgxpool.Pool
 }
 
-func NewService(db *pgx.Conn, rdb *redis.Client) *Service {
+func NewService(db *pgxpool.Pool, rdb *redis.Client) *Service {
 	return &Service{
 		rdb: rdb,
 		db:  db,
@@ -31,7 +31,7 @@ func (s *Service) GetInfo(uid int) (*models.Account, error) {
 	accountInfoJson, err := s.rdb.Get(context.Background(), fmt.Sprintf("account:%d", uid)).Result()
 	if err == redis.Nil {
 		if err := pgxscan.Get(context.Background(), s.db, &account,
-			"SELECT first_name, last_name, email FROM accounts WHERE id = $1",
+			"SELECT COALESCE(first_name, '') AS first_name, COALESCE(last_name, '') AS last_name, COALESCE(email, '') AS email FROM accounts WHERE id = $1",
 			uid); err != nil {
 			return nil, fmt.Errorf("postgres select: %w", err)
 		}
@@ -43,6 +43,7 @@ func (s *Service) GetInfo(uid int) (*models.Account, error) {
 			return nil, fmt.Errorf("redis set: %w", err)
 		}
 	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
 	} else {
 		if err := json.Unmarshal([]byte(accountInfoJson), &account); err != nil {
 			return nil, fmt.Errorf("json unmarshal: %w", err)
@@ -52,6 +53,20 @@ func (s *Service) GetInfo(uid int) (*models.Account, error) {
 	return &account, nil
 }
 
-func (s *Service) UpdateInfo(uid int, req models.UpdatePlayerRequest) error {
-	return nil
+// UpdateInfo applies a partial update and drops the account:<uid> cache, and
+// profile:<uid> whose display name falls back to the first name. A
+// write-through could race another update and cache the older row.
+func (s *Service) UpdateInfo(uid int, req models.UpdatePlayerRequest) (*models.Account, error) {
+	account := models.Account{}
+	if err := pgxscan.Get(context.Background(), s.db, &account,
+		"UPDATE accounts SET first_name = COALESCE($1, first_name), last_name = COALESCE($2, last_name) WHERE id = $3 RETURNING COALESCE(first_name, '') AS first_name, COALESCE(last_name, '') AS last_name, COALESCE(email, '') AS email",
+		req.FirstName, req.LastName, uid); err != nil {
+		return nil, fmt.Errorf("postgres update: %w", err)
+	}
+
+	if err := s.rdb.Del(context.Background(), fmt.Sprintf("account:%d", uid), fmt.Sprintf("profile:%d", uid)).Err(); err != nil {
+		return nil, fmt.Errorf("redis del: %w", err)
+	}
+
+	return &account, nil
 }
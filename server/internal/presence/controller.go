@@ -0,0 +1,232 @@
+package presence
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server/internal/env"
+	"server/internal/middlewares"
+	"server/internal/models"
+	"server/pkg/betools"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxUIDsPerRequest = 100
+
+type Controller struct {
+	svc *Service
+}
+
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
+}
+
+func (c *Controller) GetRoutes() []betools.Route {
+	routes := betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "GET",
+				Pattern:     "/presence",
+				HandlerFunc: c.handleGetMany,
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/presence/events",
+				HandlerFunc: c.handleEvents,
+			},
+			{
+				Method:      "POST",
+				Pattern:     "/presence/heartbeat",
+				HandlerFunc: c.handleHeartbeat,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.HeartbeatRequest](),
+				},
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/presence/me",
+				HandlerFunc: c.handleSetOffline,
+			},
+		},
+	)
+
+	return append(routes, betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.APIKeyMiddleware,
+			middlewares.RequireScope(models.ScopePresenceWrite),
+		},
+		[]betools.Route{
+			{
+				Method:      "PUT",
+				Pattern:     "/service/players/{uid}/presence",
+				HandlerFunc: c.handleServiceSetPresence,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.SetPresenceRequest](),
+				},
+			},
+		},
+	)...)
+}
+
+func (c *Controller) handleGetMany(w http.ResponseWriter, r *http.Request) {
+	uids, err := parseUIDs(r.URL.Query().Get("uids"))
+	if err != nil {
+		slog.Error("get presence", "uids", r.URL.Query().Get("uids"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := c.svc.GetMany(uids)
+	if err != nil {
+		slog.Error("get presence", "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get presence")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+// handleEvents streams the presence of the given players over SSE: a snapshot
+// event first, then a presence event for each change. The stream ends with an
+// error event once the caller's token is revoked or they are banned.
+func (c *Controller) handleEvents(w http.ResponseWriter, r *http.Request) {
+	auth := betools.GetAuthCtx(r)
+	uids, err := parseUIDs(r.URL.Query().Get("uids"))
+	if err != nil {
+		slog.Error("presence events", "uids", r.URL.Query().Get("uids"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("presence events", "error", "streaming unsupported")
+		betools.SendErrorResponse(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	// watching before taking the snapshot, so no change falls in between
+	watcher, err := c.svc.Watch(r.Context(), uids)
+	if err != nil {
+		slog.Error("presence events", "error", err)
+		betools.SendErrorResponse(w, http.StatusInternalServerError, "failed to subscribe")
+		return
+	}
+	defer c.svc.Unwatch(watcher)
+
+	snapshot, err := c.svc.GetMany(uids)
+	if err != nil {
+		slog.Error("presence events", "error", err)
+		betools.SendErrorResponse(w, http.StatusInternalServerError, "failed to get presence")
+		return
+	}
+
+	betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+		Event: "snapshot",
+		Data:  snapshot,
+	})
+
+	recheck := time.NewTicker(time.Duration(env.C.StreamAuthRecheckSeconds) * time.Second)
+	defer recheck.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-recheck.C:
+			if err := middlewares.Recheck(auth); err != nil {
+				slog.Error("presence events", "uid", auth.UserID, "error", err)
+				betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+					Event: "error",
+					Error: err,
+				})
+				return
+			}
+		case p, ok := <-watcher.C:
+			if !ok {
+				return
+			}
+
+			betools.SendEventsResponse(w, flusher, betools.SSEEvents{
+				Event: "presence",
+				Data:  p,
+			})
+		}
+	}
+}
+
+func (c *Controller) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.HeartbeatRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	if err := c.svc.Heartbeat(uid, req.Status); err != nil {
+		slog.Error("presence heartbeat", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update presence")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleSetOffline(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	if err := c.svc.SetOffline(uid); err != nil {
+		slog.Error("presence offline", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update presence")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleServiceSetPresence(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.SetPresenceRequest](r)
+	service := betools.GetServiceCtx(r)
+
+	uid, err := strconv.Atoi(chi.URLParam(r, "uid"))
+	if err != nil {
+		slog.Error("service set presence", "key_id", service.KeyID, "uid", chi.URLParam(r, "uid"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update presence")
+		return
+	}
+
+	if err := c.svc.SetActivity(uid, req.Status, req.Activity); err != nil {
+		slog.Error("service set presence", "key_id", service.KeyID, "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to update presence")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func parseUIDs(param string) ([]int, error) {
+	if param == "" {
+		return nil, fmt.Errorf("uids required")
+	}
+
+	parts := strings.Split(param, ",")
+	if len(parts) > maxUIDsPerRequest {
+		return nil, fmt.Errorf("at most %d uids per request", maxUIDsPerRequest)
+	}
+
+	uids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		uid, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q", part)
+		}
+		uids = append(uids, uid)
+	}
+
+	return uids, nil
+}
@@ -0,0 +1,121 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"server/internal/models"
+	"sync"
+	"time"
+)
+
+// Each instance subscribes to the presence channel once. RunHub decodes every
+// change and hands it to the streams watching that player, so viewers do not
+// hold a Valkey connection each.
+
+const watcherBuffer = 64
+
+// Watcher receives the changes of the players it watches on C. C is closed
+// when the watcher falls too far behind; the stream should end so the client
+// reconnects and starts from a fresh snapshot.
+type Watcher struct {
+	C    chan models.Presence
+	uids []int
+}
+
+type hub struct {
+	sync.Mutex
+	ready    chan struct{}
+	watchers map[int]map[*Watcher]bool
+}
+
+func newHub() *hub {
+	return &hub{
+		ready:    make(chan struct{}),
+		watchers: map[int]map[*Watcher]bool{},
+	}
+}
+
+// RunHub subscribes to the presence channel and fans the changes out to the
+// watchers. Watch waits until it is subscribed.
+func (s *Service) RunHub() {
+	sub := s.rdb.Subscribe(context.Background(), Channel)
+	defer sub.Close()
+
+	for {
+		if _, err := sub.Receive(context.Background()); err != nil {
+			slog.Error("presence hub", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		break
+	}
+	close(s.hub.ready)
+
+	for msg := range sub.Channel() {
+		p := models.Presence{}
+		if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+			slog.Error("presence hub", "error", err)
+			continue
+		}
+
+		s.hub.publish(p)
+	}
+}
+
+// Watch starts watching the players. Changes are only delivered from here
+// on, so a snapshot taken after Watch misses none. The caller unwatches.
+func (s *Service) Watch(ctx context.Context, uids []int) (*Watcher, error) {
+	select {
+	case <-s.hub.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	w := &Watcher{
+		C:    make(chan models.Presence, watcherBuffer),
+		uids: uids,
+	}
+
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	for _, uid := range uids {
+		if s.hub.watchers[uid] == nil {
+			s.hub.watchers[uid] = map[*Watcher]bool{}
+		}
+		s.hub.watchers[uid][w] = true
+	}
+
+	return w, nil
+}
+
+func (s *Service) Unwatch(w *Watcher) {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	s.hub.remove(w)
+}
+
+func (h *hub) publish(p models.Presence) {
+	h.Lock()
+	defer h.Unlock()
+
+	for w := range h.watchers[p.UserID] {
+		select {
+		case w.C <- p:
+		default:
+			slog.Error("presence hub", "uid", p.UserID, "error", "watcher too slow, dropped")
+			h.remove(w)
+			close(w.C)
+		}
+	}
+}
+
+// remove must be called with the lock held.
+func (h *hub) remove(w *Watcher) {
+	for _, uid := range w.uids {
+		delete(h.watchers[uid], w)
+		if len(h.watchers[uid]) == 0 {
+			delete(h.watchers, uid)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package presence
+
+import (
+	"context"
+	"server/internal/models"
+	"testing"
+)
+
+func newTestHubService(t *testing.T) *Service {
+	t.Helper()
+
+	s := NewService(nil)
+	close(s.hub.ready)
+
+	return s
+}
+
+func TestHubFanOut(t *testing.T) {
+	s := newTestHubService(t)
+
+	a, err := s.Watch(context.Background(), []int{1, 2})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	b, err := s.Watch(context.Background(), []int{2})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	s.hub.publish(models.Presence{UserID: 1, Status: models.PresenceOnline})
+	s.hub.publish(models.Presence{UserID: 2, Status: models.PresenceAway})
+	s.hub.publish(models.Presence{UserID: 3, Status: models.PresenceOnline})
+
+	if got := len(a.C); got != 2 {
+		t.Fatalf("watcher of 1 and 2: got %d changes, want 2", got)
+	}
+	if got := len(b.C); got != 1 {
+		t.Fatalf("watcher of 2: got %d changes, want 1", got)
+	}
+	if p := <-b.C; p.UserID != 2 || p.Status != models.PresenceAway {
+		t.Fatalf("watcher of 2: got %+v", p)
+	}
+
+	s.Unwatch(a)
+	s.hub.publish(models.Presence{UserID: 1, Status: models.PresenceOffline})
+	if got := len(a.C); got != 2 {
+		t.Fatalf("unwatched: got %d changes, want 2", got)
+	}
+	if _, ok := s.hub.watchers[1]; ok {
+		t.Fatal("unwatched player still tracked")
+	}
+}
+
+func TestHubDropsSlowWatcher(t *testing.T) {
+	s := newTestHubService(t)
+
+	w, err := s.Watch(context.Background(), []int{1})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	for range watcherBuffer + 1 {
+		s.hub.publish(models.Presence{UserID: 1, Status: models.PresenceOnline})
+	}
+
+	for range watcherBuffer {
+		<-w.C
+	}
+	if _, ok := <-w.C; ok {
+		t.Fatal("slow watcher not closed")
+	}
+
+	// unwatching a dropped watcher is harmless
+	s.Unwatch(w)
+}
+
+func TestWatchWaitsForSubscription(t *testing.T) {
+	s := NewService(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Watch(ctx, []int{1}); err == nil {
+		t.Fatal("watch before the hub subscribed: want an error")
+	}
+}
@@ -0,0 +1,226 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"server/internal/env"
+	"server/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Each online player has a presence:<uid> hash expiring PresenceTTLSeconds
+// after their last heartbeat, and an entry in the presence_seen sorted set
+// scored by that heartbeat. The hash alone answers reads; the sorted set lets
+// the sweeper notice expired players and announce them offline, since a key
+// expiring on its own tells nobody.
+//
+// Every status change is published as a models.Presence on the presence
+// channel.
+const (
+	seenKey = "presence_seen"
+	Channel = "presence"
+)
+
+// setScript writes the presence at KEYS[1] and returns the old and new
+// status and activity. A heartbeat (ARGV[1]) only refreshes the TTL of a
+// player in a lobby or match, so the client ticking in the background does
+// not knock them back to online.
+var setScript = redis.NewScript(`
+local old = redis.call("HGET", KEYS[1], "status") or "offline"
+local oldActivity = redis.call("HGET", KEYS[1], "activity") or ""
+local status, activity = ARGV[2], ARGV[3]
+if ARGV[1] == "heartbeat" and (old == "in_lobby" or old == "in_match") then
+	status, activity = old, oldActivity
+end
+local updated = redis.call("HGET", KEYS[1], "updated_at")
+if status ~= old or activity ~= oldActivity or not updated then
+	updated = ARGV[4]
+end
+redis.call("HSET", KEYS[1], "status", status, "activity", activity, "updated_at", updated)
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[6])
+return {old, oldActivity, status, activity}
+`)
+
+// offlineScript removes the player from presence_seen (KEYS[2]) and returns 1
+// if this call did it, so only one instance announces them offline. Unless
+// forced (ARGV[2]) a player whose hash is still alive is left alone, they
+// heartbeated since the sweeper looked.
+var offlineScript = redis.NewScript(`
+if ARGV[2] ~= "force" and redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+return redis.call("ZREM", KEYS[2], ARGV[1])
+`)
+
+type Service struct {
+	rdb *redis.Client
+	hub *hub
+}
+
+func NewService(rdb *redis.Client) *Service {
+	return &Service{
+		rdb: rdb,
+		hub: newHub(),
+	}
+}
+
+// Heartbeat keeps the player online (or away) for another PresenceTTLSeconds.
+func (s *Service) Heartbeat(uid int, status string) error {
+	return s.set(uid, "heartbeat", status, "")
+}
+
+// SetActivity moves the player to a status set by another subsystem: in_lobby
+// by lobbies, in_match by match servers, and back to online when they leave.
+func (s *Service) SetActivity(uid int, status string, activity string) error {
+	return s.set(uid, "set", status, activity)
+}
+
+// SetOffline takes the player offline right away, on logout or when the
+// client closes.
+func (s *Service) SetOffline(uid int) error {
+	return s.offline(uid, true)
+}
+
+func (s *Service) set(uid int, mode string, status string, activity string) error {
+	now := time.Now()
+	ttl := time.Duration(env.C.PresenceTTLSeconds) * time.Second
+
+	res, err := setScript.Run(context.Background(), s.rdb,
+		[]string{fmt.Sprintf("presence:%d", uid), seenKey},
+		mode, status, activity, now.UnixMilli(), ttl.Milliseconds(), uid,
+	).StringSlice()
+	if err != nil {
+		return fmt.Errorf("redis set presence: %w", err)
+	}
+
+	if res[0] == res[2] && res[1] == res[3] {
+		return nil
+	}
+
+	return s.publish(models.Presence{
+		UserID:    uid,
+		Status:    res[2],
+		Activity:  res[3],
+		UpdatedAt: now,
+	})
+}
+
+func (s *Service) offline(uid int, force bool) error {
+	mode := ""
+	if force {
+		mode = "force"
+	}
+
+	removed, err := offlineScript.Run(context.Background(), s.rdb,
+		[]string{fmt.Sprintf("presence:%d", uid), seenKey},
+		uid, mode,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("redis set offline: %w", err)
+	}
+
+	if removed == 0 {
+		return nil
+	}
+
+	return s.publish(models.Presence{
+		UserID:    uid,
+		Status:    models.PresenceOffline,
+		UpdatedAt: time.Now(),
+	})
+}
+
+func (s *Service) publish(p models.Presence) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	if err := s.rdb.Publish(context.Background(), Channel, payload).Err(); err != nil {
+		return fmt.Errorf("redis publish: %w", err)
+	}
+
+	return nil
+}
+
+// GetMany returns the presence of every given player, offline for those
+// without one.
+func (s *Service) GetMany(uids []int) ([]models.Presence, error) {
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(uids))
+	for i, uid := range uids {
+		cmds[i] = pipe.HGetAll(context.Background(), fmt.Sprintf("presence:%d", uid))
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("redis pipeline: %w", err)
+	}
+
+	presences := make([]models.Presence, len(uids))
+	for i, uid := range uids {
+		fields := cmds[i].Val()
+
+		presences[i] = models.Presence{
+			UserID: uid,
+			Status: models.PresenceOffline,
+		}
+		if status, ok := fields["status"]; ok {
+			presences[i].Status = status
+			presences[i].Activity = fields["activity"]
+			if updatedAt, err := strconv.ParseInt(fields["updated_at"], 10, 64); err == nil {
+				presences[i].UpdatedAt = time.UnixMilli(updatedAt)
+			}
+		}
+	}
+
+	return presences, nil
+}
+
+// Subscribe returns the stream of every presence change. The caller closes
+// it. Streams watching a few players use Watch instead.
+func (s *Service) Subscribe(ctx context.Context) *redis.PubSub {
+	return s.rdb.Subscribe(ctx, Channel)
+}
+
+// RunSweeper announces players whose heartbeats stopped as offline. It runs
+// on every instance; offlineScript makes sure each player is announced once.
+func (s *Service) RunSweeper() {
+	ticker := time.NewTicker(time.Duration(env.C.PresenceSweepSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.sweep(); err != nil {
+			slog.Error("presence sweep", "error", err)
+		}
+	}
+}
+
+func (s *Service) sweep() error {
+	cutoff := time.Now().Add(-time.Duration(env.C.PresenceTTLSeconds) * time.Second)
+
+	expired, err := s.rdb.ZRangeByScore(context.Background(), seenKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("redis zrangebyscore: %w", err)
+	}
+
+	for _, member := range expired {
+		uid, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		if err := s.offline(uid, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
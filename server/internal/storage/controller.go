@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server/internal/middlewares"
+	"server/internal/models"
+	"server/pkg/betools"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Controller struct {
+	svc *Service
+}
+
+func NewController(svc *Service) *Controller {
+	return &Controller{
+		svc: svc,
+	}
+}
+
+func (c *Controller) GetRoutes() []betools.Route {
+	return betools.WithMiddlewares(
+		[]betools.Middleware{
+			middlewares.AuthMiddleware,
+		},
+		[]betools.Route{
+			{
+				Method:      "GET",
+				Pattern:     "/player/me/storage",
+				HandlerFunc: c.handleList,
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/player/me/storage/{key}",
+				HandlerFunc: c.handleGet,
+			},
+			{
+				Method:      "PUT",
+				Pattern:     "/player/me/storage/{key}",
+				HandlerFunc: c.handlePut,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.PutStorageRequest](),
+				},
+			},
+			{
+				Method:      "DELETE",
+				Pattern:     "/player/me/storage/{key}",
+				HandlerFunc: c.handleDelete,
+			},
+			{
+				Method:      "GET",
+				Pattern:     "/player/me/settings",
+				HandlerFunc: c.handleGetSettings,
+			},
+			{
+				Method:      "PUT",
+				Pattern:     "/player/me/settings",
+				HandlerFunc: c.handlePutSettings,
+				Middlewares: []betools.Middleware{
+					betools.BodyParser[models.PutSettingsRequest](),
+				},
+			},
+		},
+	)
+}
+
+func (c *Controller) handleList(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.List(uid)
+	if err != nil {
+		slog.Error("list storage", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to list storage")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handleGet(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	key := chi.URLParam(r, "key")
+
+	res, err := c.svc.Get(uid, key)
+	if errors.Is(err, ErrNotFound) {
+		slog.Error("get storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusNotFound, "storage entry not found")
+		return
+	} else if err != nil {
+		slog.Error("get storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get storage entry")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handlePut(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.PutStorageRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+	key := chi.URLParam(r, "key")
+
+	res, err := c.svc.Put(uid, key, req)
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		slog.Error("put storage entry", "uid", uid, "key", key, "error", err)
+		sendVersionConflict(w, conflict)
+		return
+	} else if errors.Is(err, ErrInvalidKey) {
+		slog.Error("put storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, ErrValueTooLarge) {
+		slog.Error("put storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if errors.Is(err, ErrTooManyKeys) {
+		slog.Error("put storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		slog.Error("put storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to put storage entry")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+// handleDelete takes the version being deleted as ?version=.
+func (c *Controller) handleDelete(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+	key := chi.URLParam(r, "key")
+
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version < 1 {
+		slog.Error("delete storage entry", "uid", uid, "key", key, "version", r.URL.Query().Get("version"), "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "version must be a positive integer")
+		return
+	}
+
+	err = c.svc.Delete(uid, key, version)
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		slog.Error("delete storage entry", "uid", uid, "key", key, "error", err)
+		sendVersionConflict(w, conflict)
+		return
+	} else if err != nil {
+		slog.Error("delete storage entry", "uid", uid, "key", key, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to delete storage entry")
+		return
+	}
+
+	betools.SendOKResponse(w)
+}
+
+func (c *Controller) handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.GetSettings(uid)
+	if err != nil {
+		slog.Error("get settings", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to get settings")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func (c *Controller) handlePutSettings(w http.ResponseWriter, r *http.Request) {
+	req := betools.GetBodyCtx[models.PutSettingsRequest](r)
+	uid := betools.GetAuthCtx(r).UserID
+
+	res, err := c.svc.PutSettings(uid, req)
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		slog.Error("put settings", "uid", uid, "error", err)
+		sendVersionConflict(w, conflict)
+		return
+	} else if errors.Is(err, ErrValueTooLarge) {
+		slog.Error("put settings", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
+		slog.Error("put settings", "uid", uid, "error", err)
+		betools.SendErrorResponse(w, http.StatusBadRequest, "failed to put settings")
+		return
+	}
+
+	betools.SendOKResponse(w, res)
+}
+
+func sendVersionConflict(w http.ResponseWriter, conflict *VersionConflictError) {
+	betools.SendErrorCodeResponse(w, http.StatusConflict, "version_conflict", "stored version has changed", models.VersionConflictDetails{
+		CurrentVersion: conflict.Current,
+	})
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"server/internal/env"
+	"server/internal/models"
+	"time"
+
+	"github.com/georgysavva/scany/v2/pgxscan"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Entries and the settings document are versioned: every write names the
+// version it replaces and fails with a VersionConflictError when another
+// device got there first. Entries read are cached at storage:<uid>:<key> and
+// settings at settings:<uid>, writes go through to the cache. The cache only
+// ever moves to a newer version, so a slow writer or a read filling the cache
+// cannot put back an older one. Deleted entries leave a marker there until
+// the cache would have expired.
+
+var (
+	ErrNotFound      = errors.New("storage entry not found")
+	ErrInvalidKey    = errors.New("keys are 1 to 64 letters, digits, dots, dashes or underscores")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrTooManyKeys   = errors.New("too many storage keys")
+)
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const deletedMarker = `{"deleted":true}`
+
+// cacheScript caches ARGV[1] at version ARGV[2] in KEYS[1] for ARGV[3] ms,
+// unless the same or a newer version is cached. A read filling the cache
+// (ARGV[4] == "fill") also leaves a deletion marker alone.
+var cacheScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current then
+	local cached = cjson.decode(current)
+	if cached.deleted then
+		if ARGV[4] == "fill" then
+			return 0
+		end
+	elseif tonumber(cached.version) >= tonumber(ARGV[2]) then
+		return 0
+	end
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+// VersionConflictError is returned when the version given is not the current
+// one. Current is 0 when there is nothing stored.
+type VersionConflictError struct {
+	Current int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict, current version is %d", e.Current)
+}
+
+type Service struct {
+	rdb *redis.Client
+	db  *pgxpool.Pool
+}
+
+func NewService(db *pgxpool.Pool, rdb *redis.Client) *Service {
+	return &Service{
+		rdb: rdb,
+		db:  db,
+	}
+}
+
+// List returns the player's entries without their values.
+func (s *Service) List(uid int) ([]models.StorageEntry, error) {
+	entries := []models.StorageEntry{}
+	if err := pgxscan.Select(context.Background(), s.db, &entries,
+		"SELECT key, version, updated_at FROM player_storage WHERE account_id = $1 ORDER BY key",
+		uid,
+	); err != nil {
+		return nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	return entries, nil
+}
+
+func (s *Service) Get(uid int, key string) (*models.StorageEntry, error) {
+	entry := models.StorageEntry{}
+
+	entryJson, err := s.rdb.Get(context.Background(), entryKey(uid, key)).Result()
+	if err == redis.Nil {
+		if err := pgxscan.Get(context.Background(), s.db, &entry,
+			"SELECT key, value, version, updated_at FROM player_storage WHERE account_id = $1 AND key = $2",
+			uid, key); pgxscan.NotFound(err) {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, fmt.Errorf("postgres select: %w", err)
+		}
+
+		if err := s.cache(entryKey(uid, key), entry, entry.Version, "fill"); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	} else if entryJson == deletedMarker {
+		return nil, ErrNotFound
+	} else {
+		if err := json.Unmarshal([]byte(entryJson), &entry); err != nil {
+			return nil, fmt.Errorf("json unmarshal: %w", err)
+		}
+	}
+
+	return &entry, nil
+}
+
+// Put creates the entry when version is 0, or replaces the given version.
+func (s *Service) Put(uid int, key string, req models.PutStorageRequest) (*models.StorageEntry, error) {
+	if !keyPattern.MatchString(key) {
+		return nil, ErrInvalidKey
+	}
+	if len(req.Value) > env.C.StorageMaxValueBytes {
+		return nil, ErrValueTooLarge
+	}
+
+	entry := models.StorageEntry{}
+	var err error
+	if req.Version == 0 {
+		entry, err = s.insert(uid, key, req.Value)
+	} else {
+		err = pgxscan.Get(context.Background(), s.db, &entry,
+			`UPDATE player_storage SET value = $1, version = version + 1, updated_at = NOW()
+			WHERE account_id = $2 AND key = $3 AND version = $4 RETURNING key, value, version, updated_at`,
+			req.Value, uid, key, req.Version)
+	}
+	if pgxscan.NotFound(err) {
+		return nil, s.conflict(uid, key)
+	} else if errors.Is(err, ErrTooManyKeys) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("postgres upsert: %w", err)
+	}
+
+	if err := s.cache(entryKey(uid, key), entry, entry.Version, "write"); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// insert creates the entry at version 1. Keys are counted under a lock on
+// the account row, so concurrent writes cannot both take the last free key.
+func (s *Service) insert(uid int, key string, value json.RawMessage) (models.StorageEntry, error) {
+	entry := models.StorageEntry{}
+
+	tx, err := s.db.Begin(context.Background())
+	if err != nil {
+		return entry, fmt.Errorf("postgres begin: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(),
+		"SELECT 1 FROM accounts WHERE id = $1 FOR NO KEY UPDATE",
+		uid,
+	); err != nil {
+		return entry, fmt.Errorf("postgres lock: %w", err)
+	}
+
+	// an existing key is a conflict, whatever the count
+	var count int
+	var exists bool
+	if err := tx.QueryRow(context.Background(),
+		"SELECT COUNT(*), COUNT(*) FILTER (WHERE key = $2) > 0 FROM player_storage WHERE account_id = $1",
+		uid, key,
+	).Scan(&count, &exists); err != nil {
+		return entry, fmt.Errorf("postgres select: %w", err)
+	}
+	if exists {
+		return entry, pgx.ErrNoRows
+	}
+	if count >= env.C.StorageMaxKeys {
+		return entry, ErrTooManyKeys
+	}
+
+	// pgxscan's not found error is left for Put to report as a conflict
+	if err := pgxscan.Get(context.Background(), tx, &entry,
+		`INSERT INTO player_storage (account_id, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, key) DO NOTHING RETURNING key, value, version, updated_at`,
+		uid, key, value,
+	); err != nil {
+		return entry, err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return entry, fmt.Errorf("postgres commit: %w", err)
+	}
+
+	return entry, nil
+}
+
+func (s *Service) Delete(uid int, key string, version int) error {
+	tag, err := s.db.Exec(context.Background(),
+		"DELETE FROM player_storage WHERE account_id = $1 AND key = $2 AND version = $3",
+		uid, key, version)
+	if err != nil {
+		return fmt.Errorf("postgres delete: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.conflict(uid, key)
+	}
+
+	if err := s.rdb.Set(context.Background(), entryKey(uid, key), deletedMarker,
+		time.Duration(env.C.StorageCacheSeconds)*time.Second,
+	).Err(); err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+
+	return nil
+}
+
+// conflict explains a write that matched no row: the entry is missing, or at
+// another version.
+func (s *Service) conflict(uid int, key string) error {
+	var current int
+	err := s.db.QueryRow(context.Background(),
+		"SELECT version FROM player_storage WHERE account_id = $1 AND key = $2",
+		uid, key,
+	).Scan(&current)
+	if err == pgx.ErrNoRows {
+		return &VersionConflictError{}
+	} else if err != nil {
+		return fmt.Errorf("postgres select: %w", err)
+	}
+
+	return &VersionConflictError{Current: current}
+}
+
+// cache stores v at version in key, see cacheScript. mode is "fill" on a
+// cache miss and "write" after a write.
+func (s *Service) cache(key string, v any, version int, mode string) error {
+	vJson, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	if err := cacheScript.Run(context.Background(), s.rdb,
+		[]string{key},
+		string(vJson), version, (time.Duration(env.C.StorageCacheSeconds) * time.Second).Milliseconds(), mode,
+	).Err(); err != nil {
+		return fmt.Errorf("redis cache: %w", err)
+	}
+
+	return nil
+}
+
+// GetSettings returns the settings document, empty at version 0 when it was
+// never saved.
+func (s *Service) GetSettings(uid int) (*models.PlayerSettings, error) {
+	settings := models.PlayerSettings{}
+
+	settingsJson, err := s.rdb.Get(context.Background(), settingsKey(uid)).Result()
+	if err == redis.Nil {
+		if err := pgxscan.Get(context.Background(), s.db, &settings,
+			"SELECT settings, version, updated_at FROM player_settings WHERE account_id = $1",
+			uid); pgxscan.NotFound(err) {
+			settings = models.PlayerSettings{Settings: json.RawMessage("{}")}
+		} else if err != nil {
+			return nil, fmt.Errorf("postgres select: %w", err)
+		}
+
+		if err := s.cache(settingsKey(uid), settings, settings.Version, "fill"); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	} else {
+		if err := json.Unmarshal([]byte(settingsJson), &settings); err != nil {
+			return nil, fmt.Errorf("json unmarshal: %w", err)
+		}
+	}
+
+	return &settings, nil
+}
+
+// PutSettings replaces the whole settings document at the given version.
+func (s *Service) PutSettings(uid int, req models.PutSettingsRequest) (*models.PlayerSettings, error) {
+	if len(req.Settings) > env.C.StorageMaxValueBytes {
+		return nil, ErrValueTooLarge
+	}
+
+	settings := models.PlayerSettings{}
+	var err error
+	if req.Version == 0 {
+		err = pgxscan.Get(context.Background(), s.db, &settings,
+			`INSERT INTO player_settings (account_id, settings) VALUES ($1, $2)
+			ON CONFLICT (account_id) DO NOTHING RETURNING settings, version, updated_at`,
+			uid, req.Settings)
+	} else {
+		err = pgxscan.Get(context.Background(), s.db, &settings,
+			`UPDATE player_settings SET settings = $1, version = version + 1, updated_at = NOW()
+			WHERE account_id = $2 AND version = $3 RETURNING settings, version, updated_at`,
+			req.Settings, uid, req.Version)
+	}
+	if pgxscan.NotFound(err) {
+		var current int
+		if err := s.db.QueryRow(context.Background(),
+			"SELECT version FROM player_settings WHERE account_id = $1",
+			uid,
+		).Scan(&current); err != nil && err != pgx.ErrNoRows {
+			return nil, fmt.Errorf("postgres select: %w", err)
+		}
+		return nil, &VersionConflictError{Current: current}
+	} else if err != nil {
+		return nil, fmt.Errorf("postgres upsert: %w", err)
+	}
+
+	if err := s.cache(settingsKey(uid), settings, settings.Version, "write"); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// Export returns every entry with its value, and the settings document, for
+// the player's data export.
+func (s *Service) Export(uid int) ([]models.StorageEntry, *models.PlayerSettings, error) {
+	entries := []models.StorageEntry{}
+	if err := pgxscan.Select(context.Background(), s.db, &entries,
+		"SELECT key, value, version, updated_at FROM player_storage WHERE account_id = $1 ORDER BY key",
+		uid,
+	); err != nil {
+		return nil, nil, fmt.Errorf("postgres select: %w", err)
+	}
+
+	settings, err := s.GetSettings(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return entries, settings, nil
+}
+
+// DeleteAll drops everything the player stored within tx, when their account
+// is deleted. It returns the cache keys to drop once tx is committed.
+func (s *Service) DeleteAll(tx pgx.Tx, uid int) ([]string, error) {
+	var keys []string
+	if err := pgxscan.Select(context.Background(), tx, &keys,
+		"DELETE FROM player_storage WHERE account_id = $1 RETURNING key",
+		uid,
+	); err != nil {
+		return nil, fmt.Errorf("postgres delete: %w", err)
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM player_settings WHERE account_id = $1", uid); err != nil {
+		return nil, fmt.Errorf("postgres delete: %w", err)
+	}
+
+	cacheKeys := []string{settingsKey(uid)}
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, entryKey(uid, key))
+	}
+
+	return cacheKeys, nil
+}
+
+func entryKey(uid int, key string) string {
+	return fmt.Sprintf("storage:%d:%s", uid, key)
+}
+
+func settingsKey(uid int) string {
+	return fmt.Sprintf("settings:%d", uid)
+}
@@ -0,0 +1,71 @@
+// Package throttle counts failures in sliding windows kept in Valkey, as
+// sorted sets of failure timestamps, and locks a key out past a maximum.
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// recordScript adds a failure at ARGV[1] (unix ms) to the window of ARGV[2]
+// ms at KEYS[1] and returns the number of failures left in the window.
+var recordScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", tonumber(ARGV[1]) - tonumber(ARGV[2]))
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return redis.call("ZCARD", KEYS[1])
+`)
+
+// attemptScript refuses with the time left while KEYS[2] is locked, or when
+// the window of ARGV[2] ms at KEYS[1] already holds ARGV[4] attempts, locking
+// KEYS[2] for ARGV[5] ms. Otherwise it adds the attempt at ARGV[1] and
+// returns 0.
+var attemptScript = redis.NewScript(`
+local locked = redis.call("PTTL", KEYS[2])
+if locked > 0 then
+	return locked
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", tonumber(ARGV[1]) - tonumber(ARGV[2]))
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[4]) then
+	redis.call("SET", KEYS[2], 1, "PX", ARGV[5])
+	return tonumber(ARGV[5])
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 0
+`)
+
+// Attempt counts an attempt in the window at key before it is checked, so
+// concurrent attempts cannot get past max between a check and a failure. It
+// returns how long the caller has to wait when lockKey is locked or the window
+// is full, and 0 when the attempt may go ahead. A successful attempt should
+// delete key.
+func Attempt(rdb *redis.Client, key string, lockKey string, window time.Duration, max int, lockout time.Duration) (time.Duration, error) {
+	wait, err := attemptScript.Run(context.Background(), rdb,
+		[]string{key, lockKey},
+		time.Now().UnixMilli(), window.Milliseconds(), uuid.NewString(), max, lockout.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("redis attempt: %w", err)
+	}
+
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// RecordFailure adds a failure to the window at key and returns how many
+// failures the window holds, for the caller to decide on a lockout.
+func RecordFailure(rdb *redis.Client, key string, window time.Duration) (int, error) {
+	failures, err := recordScript.Run(context.Background(), rdb,
+		[]string{key},
+		time.Now().UnixMilli(), window.Milliseconds(), uuid.NewString(),
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("redis record failure: %w", err)
+	}
+
+	return failures, nil
+}
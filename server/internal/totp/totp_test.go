@@ -0,0 +1,60 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1, truncated to our 6 digits.
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestGenerateRFCVectors(t *testing.T) {
+	key, err := encoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+
+	for _, v := range rfcVectors {
+		if got := generate(key, v.unix/period); got != v.code {
+			t.Errorf("at %d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+
+		step, ok := Validate(rfcSecret, v.code, at)
+		if !ok || step != v.unix/period {
+			t.Errorf("at %d: got step %d ok %v, want step %d", v.unix, step, ok, v.unix/period)
+		}
+
+		// one step of drift either way is accepted, two are not
+		if _, ok := Validate(rfcSecret, v.code, at.Add(period*time.Second)); !ok {
+			t.Errorf("at %d: code rejected one step later", v.unix)
+		}
+		if _, ok := Validate(rfcSecret, v.code, at.Add(2*period*time.Second)); ok {
+			t.Errorf("at %d: code accepted two steps later", v.unix)
+		}
+	}
+
+	if _, ok := Validate(rfcSecret, "28708", time.Unix(59, 0)); ok {
+		t.Error("short code accepted")
+	}
+	if _, ok := Validate("not base32!", "287082", time.Unix(59, 0)); ok {
+		t.Error("invalid secret accepted")
+	}
+}
@@ -6,13 +6,23 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"server/internal/apikey"
 	"server/internal/auth"
+	"server/internal/enforcement"
 	"server/internal/env"
+	"server/internal/gdpr"
+	"server/internal/jwtkeys"
+	"server/internal/lobby"
+	"server/internal/mailer"
+	"server/internal/middlewares"
 	"server/internal/player"
+	"server/internal/presence"
+	"server/internal/storage"
 	"server/pkg/betools"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -30,6 +40,10 @@ func main() {
 	}
 	slog.Info("env loaded")
 
+	if err := jwtkeys.Load(); err != nil {
+		panic("jwt keys load: " + err.Error())
+	}
+
 	slog.Info("redis connecting")
 	rdb := redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%s", env.C.ValkeyHost, env.C.ValkeyPort),
@@ -38,10 +52,23 @@ func main() {
 	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
 		panic("redis ping: " + err.Error())
 	}
+
+	// Valkey has to be a single node: some scripts, the lobby ones for
+	// instance, touch keys they are not given, which a cluster or a sharding
+	// proxy cannot route
+	clusterInfo, err := rdb.Info(context.Background(), "cluster").Result()
+	if err != nil {
+		panic("redis info: " + err.Error())
+	}
+	if strings.Contains(clusterInfo, "cluster_enabled:1") {
+		panic("redis: cluster mode is not supported, use a single node")
+	}
 	slog.Info("redis connected")
 
 	slog.Info("postgres connecting")
-	db, err := pgx.Connect(context.Background(), fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", env.C.DBHost, env.C.DBPort, env.C.DBUser, env.C.DBPass, env.C.DBName))
+	// services run queries from concurrent requests and background workers,
+	// which a single connection cannot serve
+	db, err := pgxpool.New(context.Background(), fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", env.C.DBHost, env.C.DBPort, env.C.DBUser, env.C.DBPass, env.C.DBName))
 	if err != nil {
 		panic("postgres connect: " + err.Error())
 	}
@@ -51,16 +78,60 @@ func main() {
 	}
 	slog.Info("postgres connected")
 
+	apiKeyService := apikey.NewService(db, rdb)
+	apiKeyController := apikey.NewController(apiKeyService)
+
+	enforcementService := enforcement.NewService(db, rdb)
+	enforcementController := enforcement.NewController(enforcementService)
+
+	middlewares.Init(rdb, apiKeyService, enforcementService)
+
 	r := chi.NewRouter()
 
-	authService := auth.NewService(db, rdb)
+	m, err := mailer.New()
+	if err != nil {
+		panic("mailer: " + err.Error())
+	}
+
+	providers, err := auth.LoadProviders()
+	if err != nil {
+		panic("oidc providers: " + err.Error())
+	}
+
+	authService := auth.NewService(db, rdb, m, providers, enforcementService)
 	authController := auth.NewController(authService)
 	playerService := player.NewService(db, rdb)
 	playerController := player.NewController(playerService)
+	if err := playerService.RebuildHandleIndex(); err != nil {
+		slog.Error("rebuild handle index", "error", err)
+	}
+
+	presenceService := presence.NewService(rdb)
+	presenceController := presence.NewController(presenceService)
+	go presenceService.RunSweeper()
+	go presenceService.RunHub()
+
+	lobbyService := lobby.NewService(rdb, enforcementService, presenceService)
+	lobbyController := lobby.NewController(lobbyService)
+	go lobbyService.RunDisconnectWatcher()
+	go lobbyService.RunScheduler()
+
+	storageService := storage.NewService(db, rdb)
+	storageController := storage.NewController(storageService)
+
+	gdprService := gdpr.NewService(db, rdb, authService, playerService, presenceService, storageService)
+	gdprController := gdpr.NewController(gdprService)
+	go gdprService.RunPurger()
 
 	router := betools.NewRouter(
 		authController,
 		playerController,
+		apiKeyController,
+		enforcementController,
+		presenceController,
+		lobbyController,
+		storageController,
+		gdprController,
 	)
 
 	r.Route("/", router.Route)
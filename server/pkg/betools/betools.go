@@ -2,6 +2,7 @@
 package betools
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
@@ -30,7 +32,7 @@ func WithMiddlewares(mws []Middleware, rs []Route) []Route {
 			Method:      r.Method,
 			Pattern:     r.Pattern,
 			HandlerFunc: r.HandlerFunc,
-			Middlewares: append(mws, r.Middlewares...),
+			Middlewares: append(append([]Middleware{}, mws...), r.Middlewares...),
 		})
 	}
 	return routes
@@ -97,6 +99,7 @@ type Response struct {
 	Success    bool         `json:"success"`
 	Data       any          `json:"data"`
 	Error      string       `json:"error,omitempty"`
+	Code       string       `json:"code,omitempty"`
 	Errors     []FieldError `json:"errors,omitempty"`
 	Pagination *Pagination  `json:"pagination,omitempty"`
 }
@@ -156,6 +159,32 @@ func SendErrorResponse(w http.ResponseWriter, code int, data any, errors ...Fiel
 	json.NewEncoder(w).Encode(res)
 }
 
+// SendErrorCodeResponse is SendErrorResponse with a machine readable error
+// code, and details clients can act on (e.g. when to retry) sent as data.
+func SendErrorCodeResponse(w http.ResponseWriter, status int, code string, data any, details any) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	var message string
+
+	switch t := data.(type) {
+	case string:
+		message = t
+	case error:
+		message = t.Error()
+	default:
+		message = http.StatusText(status)
+	}
+
+	res := &Response{
+		Success: false,
+		Data:    details,
+		Error:   message,
+		Code:    code,
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
 func SendSuccessResponse(w http.ResponseWriter, code int, args ...any) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -206,6 +235,8 @@ func SendCreatedResponse(w http.ResponseWriter, args ...any) {
 type BodyParserOptions struct {
 	Validate bool
 	Field    string
+	// Optional parses an empty body as an empty JSON object.
+	Optional bool
 }
 
 func BodyParser[T any](opts ...BodyParserOptions) Middleware {
@@ -230,6 +261,10 @@ func BodyParser[T any](opts ...BodyParserOptions) Middleware {
 				}
 			}
 
+			if opt.Optional && len(bytes.TrimSpace(body)) == 0 {
+				body = []byte("{}")
+			}
+
 			var data T
 			if err := json.Unmarshal(body, &data); err != nil {
 				SendErrorResponse(w, http.StatusBadRequest, "json unmarshal failed")
@@ -319,12 +354,59 @@ func SetContext(r *http.Request, key CtxKey, val any) *http.Request {
 const (
 	CtxKeyBody CtxKey = iota
 	CtxKeyAuth
+	CtxKeyService
 )
 
 func GetBodyCtx[T any](r *http.Request) T {
 	return getContext[T](r, CtxKeyBody)
 }
 
-func GetAuthCtx(r *http.Request) int {
-	return getContext[int](r, CtxKeyAuth)
+type AuthInfo struct {
+	UserID        int
+	SessionID     string
+	Roles         []string
+	EmailVerified bool
+	Guest         bool
+	IssuedAt      time.Time
+}
+
+// HasRole reports whether the caller has at least one of the given roles.
+func (a AuthInfo) HasRole(roles ...string) bool {
+	for _, want := range roles {
+		for _, have := range a.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func GetAuthCtx(r *http.Request) AuthInfo {
+	return getContext[AuthInfo](r, CtxKeyAuth)
+}
+
+// ServiceInfo identifies a backend service, such as a dedicated game server,
+// calling with an API key instead of a player token.
+type ServiceInfo struct {
+	KeyID  int      `json:"key_id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasScope reports whether the service was granted at least one of the given
+// scopes.
+func (s ServiceInfo) HasScope(scopes ...string) bool {
+	for _, want := range scopes {
+		for _, have := range s.Scopes {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func GetServiceCtx(r *http.Request) ServiceInfo {
+	return getContext[ServiceInfo](r, CtxKeyService)
 }